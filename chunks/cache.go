@@ -1,20 +1,23 @@
 package chunks
 
 import (
+	"container/list"
+	"context"
 	"fmt"
+	"sync"
 	"sync/atomic"
-	"time"
+
+	"github.com/cockroachdb/errors"
 
 	"github.com/hoyle1974/temporal/misc"
-	"github.com/patrickmn/go-cache"
+	"github.com/hoyle1974/temporal/telemetry"
 )
 
-var chunkCache = cache.New(time.Minute, time.Minute)
-
 type CacheStats struct {
-	_      misc.NoCopy
-	Hits   atomic.Int64
-	Misses atomic.Int64
+	_         misc.NoCopy
+	Hits      atomic.Int64
+	Misses    atomic.Int64
+	Evictions atomic.Int64
 }
 
 func (c *CacheStats) Hit() {
@@ -23,21 +26,192 @@ func (c *CacheStats) Hit() {
 func (c *CacheStats) Miss() {
 	c.Misses.Add(1)
 }
+func (c *CacheStats) Evict() {
+	c.Evictions.Add(1)
+}
 func (c *CacheStats) Reset() {
 	c.Hits.Store(0)
 	c.Misses.Store(0)
+	c.Evictions.Store(0)
 }
 func (c *CacheStats) String() string {
-	return fmt.Sprintf("CacheStats(Hits: %d, Misses: %d)", c.Hits.Load(), c.Misses.Load())
+	return fmt.Sprintf("CacheStats(Hits: %d, Misses: %d, Evictions: %d)", c.Hits.Load(), c.Misses.Load(), c.Evictions.Load())
+}
+
+// Cache keeps decoded chunks in memory up to a budget of bytes, evicting the least
+// recently used.  Values decoded from a chunk's diffs while it is cached are charged to
+// the budget too.  Concurrent misses for the same chunk share a single load.
+type Cache struct {
+	_       misc.NoCopy
+	lock    sync.Mutex
+	budget  int64
+	size    int64
+	lru     *list.List // Of *cacheEntry, most recently used first
+	entries map[ChunkId]*list.Element
+	loading map[ChunkId]*cacheLoad
+	metrics telemetry.Metrics
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	id    ChunkId
+	chunk Chunk
+	size  int64
+}
+
+type cacheLoad struct {
+	done  chan struct{}
+	chunk Chunk
+	err   error
 }
 
-var chunkCacheStats = CacheStats{}
+// NewCache returns a cache that holds up to budget bytes of chunks, nothing is kept if
+// budget isn't positive
+func NewCache(budget int64, metrics telemetry.Metrics) *Cache {
+	return &Cache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: map[ChunkId]*list.Element{},
+		loading: map[ChunkId]*cacheLoad{},
+		metrics: metrics,
+	}
+}
+
+func (c *Cache) Stats() *CacheStats {
+	return &c.stats
+}
+
+// Load returns the chunk for id, calling load on a miss.  Callers that miss while
+// another load of id is in flight wait for it instead.
+func (c *Cache) Load(ctx context.Context, id ChunkId, load func() (Chunk, error)) (Chunk, error) {
+	if err := ctx.Err(); err != nil {
+		return Chunk{}, errors.Wrap(err, "can not load chunk")
+	}
+	for {
+		c.lock.Lock()
+		if e, ok := c.entries[id]; ok {
+			c.lru.MoveToFront(e)
+			c.lock.Unlock()
+			c.hit()
+			return e.Value.(*cacheEntry).chunk, nil
+		}
+
+		if l, ok := c.loading[id]; ok {
+			c.lock.Unlock()
+			select {
+			case <-l.done:
+			case <-ctx.Done():
+				return Chunk{}, errors.Wrap(ctx.Err(), "can not load chunk")
+			}
+			// The load was given up by whoever started it, not by us
+			if l.err != nil && ctx.Err() == nil && (errors.Is(l.err, context.Canceled) || errors.Is(l.err, context.DeadlineExceeded)) {
+				continue
+			}
+			if l.err == nil {
+				c.hit()
+			}
+			return l.chunk, l.err
+		}
+
+		l := &cacheLoad{done: make(chan struct{})}
+		c.loading[id] = l
+		c.lock.Unlock()
+		c.miss()
+
+		l.chunk, l.err = load()
+
+		c.lock.Lock()
+		delete(c.loading, id)
+		if l.err == nil {
+			c.put(id, l.chunk)
+		}
+		c.lock.Unlock()
+		close(l.done)
+
+		return l.chunk, l.err
+	}
+}
+
+// Put adds chunk to the cache, replacing what was there for its id
+func (c *Cache) Put(chunk Chunk) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.put(chunk.Header.Id, chunk)
+}
+
+func (c *Cache) put(id ChunkId, chunk Chunk) {
+	c.remove(id)
+
+	frames := chunk.Data.frames
+	size := int64(chunk.Data.RawSize()) + frames.watch(func(bytes int64) {
+		c.grow(id, frames, bytes)
+	})
+	if size > c.budget {
+		return
+	}
+	c.entries[id] = c.lru.PushFront(&cacheEntry{id: id, chunk: chunk, size: size})
+	c.size += size
+	c.evict()
+}
+
+// grow charges bytes of newly decoded frames to the chunk they belong to
+func (c *Cache) grow(id ChunkId, frames *frameCache, bytes int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok || e.Value.(*cacheEntry).chunk.Data.frames != frames {
+		return // Evicted or replaced since
+	}
+	e.Value.(*cacheEntry).size += bytes
+	c.size += bytes
+	c.evict()
+}
+
+// evict removes the least recently used chunks until the cache is within its budget
+func (c *Cache) evict() {
+	for c.size > c.budget {
+		e := c.lru.Back()
+		c.remove(e.Value.(*cacheEntry).id)
+		c.stats.Evict()
+		c.metrics.AdjustCount("chunk_cache_evictions", 1)
+	}
+	c.metrics.SetGuage("chunk_cache_bytes", float64(c.size))
+}
+
+// Remove drops id from the cache
+func (c *Cache) Remove(id ChunkId) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove(id)
+	c.metrics.SetGuage("chunk_cache_bytes", float64(c.size))
+}
+
+func (c *Cache) remove(id ChunkId) {
+	if e, ok := c.entries[id]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, id)
+		c.size -= e.Value.(*cacheEntry).size
+	}
+}
+
+// Clear drops every chunk and resets the stats
+func (c *Cache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lru.Init()
+	c.entries = map[ChunkId]*list.Element{}
+	c.size = 0
+	c.stats.Reset()
+	c.metrics.SetGuage("chunk_cache_bytes", 0)
+}
 
-func PrintCacheStats() {
-	fmt.Println(chunkCacheStats.String())
+func (c *Cache) hit() {
+	c.stats.Hit()
+	c.metrics.AdjustCount("chunk_cache_hits", 1)
 }
 
-func ClearCache() {
-	chunkCacheStats.Reset()
-	chunkCache = cache.New(time.Minute, time.Minute)
+func (c *Cache) miss() {
+	c.stats.Miss()
+	c.metrics.AdjustCount("chunk_cache_misses", 1)
 }
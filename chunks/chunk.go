@@ -3,6 +3,7 @@ package chunks
 import (
 	"context"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/errors"
@@ -11,8 +12,9 @@ import (
 )
 
 type KVPair struct {
-	Key  string
-	Data []byte
+	Key     string
+	Data    []byte
+	Version time.Time // When Key was last written, zero if it isn't known
 }
 
 // A sorted array of KVPairs
@@ -21,6 +23,7 @@ type KeyFrame []KVPair
 type IndexedKVPair struct {
 	KeyIndex int32
 	Data     []byte
+	Version  time.Time // Only kept in seeded keyframes, the rest were written at the chunk's timestamp
 }
 
 type IndexedKeyFrame []IndexedKVPair
@@ -46,6 +49,18 @@ type DiffEvent struct {
 	Diff      Diff
 }
 
+// A delete is stored as an empty diff, every other write has at least a format byte
+func (d DiffEvent) IsDelete() bool {
+	return len(d.Diff) == 0
+}
+
+// keyLookup finds a single key's data in a loaded chunk so only that key's diffs are
+// applied.  It is built when the chunk is loaded and isn't stored.
+type keyLookup struct {
+	Frame int32   // Position in IndexedKeyFrame, -1 if the key isn't in the keyframe
+	Diffs []int32 // Positions in Diffs, in timestamp order
+}
+
 // This is what is actually stored on disk
 type ChunkData struct {
 	Id              ChunkId
@@ -53,13 +68,35 @@ type ChunkData struct {
 	Keys            []string
 	IndexedKeyFrame IndexedKeyFrame
 	Diffs           []DiffEvent
+	Seeded          bool // The keyframe is the state carried over from the previous chunk, every write is a diff
 
 	keyToIndex map[string]int32
 	indexToKey map[int32]string
-	frames     [][]byte
+	frames     *frameCache
+	lookup     []keyLookup // Indexed by key index
 	diskSize   int
 }
 
+// frameCache holds the values decoded from diffs, copies of a chunk share it
+type frameCache struct {
+	lock   sync.Mutex
+	frames [][]byte
+	bytes  int64
+	grow   func(bytes int64) // Told when frames are decoded, set by a Cache holding the chunk
+}
+
+// watch sets the function told about frames decoded from now on and returns the bytes
+// decoded so far
+func (f *frameCache) watch(grow func(bytes int64)) int64 {
+	if f == nil {
+		return 0
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.grow = grow
+	return f.bytes
+}
+
 func (c ChunkData) GetDiskSize() int {
 	return c.diskSize
 }
@@ -89,7 +126,31 @@ func (cd *ChunkData) populateNonSerializedData() {
 		cd.keyToIndex[k] = int32(idx)
 		cd.indexToKey[int32(idx)] = k
 	}
-	cd.frames = make([][]byte, len(cd.Diffs))
+	cd.frames = &frameCache{frames: make([][]byte, len(cd.Diffs))}
+
+	cd.lookup = make([]keyLookup, len(cd.Keys))
+	for idx := range cd.lookup {
+		cd.lookup[idx].Frame = -1
+	}
+	for idx, kv := range cd.IndexedKeyFrame {
+		cd.lookup[kv.KeyIndex].Frame = int32(idx)
+	}
+	for idx, diff := range cd.Diffs {
+		cd.lookup[diff.KeyIndex].Diffs = append(cd.lookup[diff.KeyIndex].Diffs, int32(idx))
+	}
+}
+
+// Checkpoints controls how a chunk's diffs are written: how often a key's full value is
+// stored instead of a diff, so reading a key never replays more than a bounded run of
+// diffs, and which codec makes the rest
+type Checkpoints struct {
+	Diffs int       // Store a full value after this many diffs, 0 disables
+	Bytes int       // Store a full value once the diffs since the last one reach this size, 0 disables
+	Codec DiffCodec // nil picks a codec for each value by its size
+}
+
+func (cp Checkpoints) due(diffs int, bytes int) bool {
+	return (cp.Diffs > 0 && diffs >= cp.Diffs) || (cp.Bytes > 0 && bytes >= cp.Bytes)
 }
 
 // This reprsents a chunk of data that would be stored on disk
@@ -98,7 +159,7 @@ type Chunk struct {
 	Data   ChunkData
 }
 
-func (c *Chunk) Finish(keyFrame KeyFrame, events []Event) {
+func (c *Chunk) Finish(keyFrame KeyFrame, events []Event, checkpoints Checkpoints) {
 	// Find and index all keys
 	keyMap := map[string]int32{}
 	for idx, kv := range keyFrame {
@@ -137,14 +198,28 @@ func (c *Chunk) Finish(keyFrame KeyFrame, events []Event) {
 	for key, events := range eventsByKey {
 		go func(key string, value []byte, events []Event) {
 			diffs := []DiffEvent{}
+			sinceCheckpoint, bytesSinceCheckpoint := 0, 0
 			for _, e := range events {
 				if e.Delete {
 					diffs = append(diffs, DiffEvent{Timestamp: e.Timestamp, KeyIndex: keyMap[e.Key], Diff: Diff{}})
 					value = []byte{}
+					sinceCheckpoint, bytesSinceCheckpoint = 0, 0
 				} else {
-					diff, err := generateDiff(value, e.Data)
-					if err != nil {
-						panic(errors.Wrap(err, "can not generate a diff, no solution for this problem"))
+					var diff Diff
+					if checkpoints.due(sinceCheckpoint, bytesSinceCheckpoint) {
+						diff = rawDiff(e.Data)
+					} else {
+						var err error
+						diff, err = generateDiff(checkpoints.Codec, value, e.Data)
+						if err != nil {
+							panic(errors.Wrap(err, "can not generate a diff, no solution for this problem"))
+						}
+					}
+					if diff.IsRaw() {
+						sinceCheckpoint, bytesSinceCheckpoint = 0, 0
+					} else {
+						sinceCheckpoint++
+						bytesSinceCheckpoint += len(diff)
 					}
 					diffs = append(diffs, DiffEvent{Timestamp: e.Timestamp, KeyIndex: keyMap[e.Key], Diff: diff})
 					value = e.Data
@@ -161,7 +236,7 @@ func (c *Chunk) Finish(keyFrame KeyFrame, events []Event) {
 	}
 
 	// Sort c.Data.Diffs by it's timestamp
-	sort.Slice(c.Data.Diffs, func(i, j int) bool {
+	sort.SliceStable(c.Data.Diffs, func(i, j int) bool {
 		return c.Data.Diffs[i].Timestamp.Before(c.Data.Diffs[j].Timestamp)
 	})
 
@@ -182,7 +257,7 @@ func NewIndexedKeyFrame(keyFrame KeyFrame, keyIndex map[string]int32) IndexedKey
 	indexedKeyFrame := make([]IndexedKVPair, 0, len(keyFrame))
 
 	for _, kv := range keyFrame {
-		indexedKeyFrame = append(indexedKeyFrame, IndexedKVPair{KeyIndex: keyIndex[kv.Key], Data: kv.Data})
+		indexedKeyFrame = append(indexedKeyFrame, IndexedKVPair{KeyIndex: keyIndex[kv.Key], Data: kv.Data, Version: kv.Version})
 	}
 
 	return indexedKeyFrame
@@ -217,37 +292,377 @@ func (c Chunk) EstimateSize() (int64, error) {
 	return int64(len(b)), nil
 }
 
-// Saves a header to the storage system
-func (c Chunk) Save(ctx context.Context, s storage.System) error {
-	c.Header.Save(ctx, s)
-
-	chunkCache.Set(string(c.Header.Id), c, time.Minute)
+// EventSize estimates how much of the encoded chunk its events take, leaving out the
+// keyframe a seeded chunk carries over from the chunk before it
+func (c Chunk) EventSize() (int64, error) {
+	b, err := misc.EncodeToBytes(c.Data.Diffs)
+	if err != nil {
+		return 0, errors.Wrap(err, "can not encode diffs to bytes to estimate size")
+	}
+	return int64(len(b)), nil
+}
 
+// Saves the chunk and then its header to the storage system
+func (c *Chunk) Save(ctx context.Context, s storage.System) error {
 	b, err := misc.EncodeToBytes(c.Data)
 	if err != nil {
 		return errors.Wrap(err, "can not encode chunk to bytes to save")
 	}
-	return s.Write(ctx, c.Data.Id.ChunkKey(), b)
+	err = s.Write(ctx, c.Data.Id.ChunkKey(), b)
+	if err != nil {
+		return errors.Wrap(err, "can not save chunk")
+	}
+	c.Header.Size = int64(len(b))
+	c.Data.diskSize = len(b)
+
+	return c.Header.Save(ctx, s)
 }
 
 func (c Chunk) GetStateAt(timestamp time.Time) (map[string][]byte, error) {
+	return c.GetRangeStateAt(timestamp, misc.KeyRange{})
+}
+
+// KeyFrame returns the chunk's keyframe with the version of each key
+func (c Chunk) KeyFrame() KeyFrame {
+	keyFrame := make(KeyFrame, 0, len(c.Data.IndexedKeyFrame))
+	for _, kv := range c.Data.IndexedKeyFrame {
+		keyFrame = append(keyFrame, KVPair{Key: c.Data.indexToKey[kv.KeyIndex], Data: kv.Data, Version: c.frameVersion(kv)})
+	}
+	sort.Slice(keyFrame, func(i, j int) bool {
+		return keyFrame[i].Key < keyFrame[j].Key
+	})
+	return keyFrame
+}
+
+// GetKeyFrameAt returns the state at timestamp with the version of each key, to seed
+// the keyframe of the chunk after this one
+func (c Chunk) GetKeyFrameAt(timestamp time.Time) (KeyFrame, error) {
+	state, err := c.GetStateAt(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := map[string]time.Time{}
+	for _, kv := range c.Data.IndexedKeyFrame {
+		versions[c.Data.indexToKey[kv.KeyIndex]] = c.frameVersion(kv)
+	}
+	for _, diff := range c.Data.Diffs {
+		if diff.Timestamp.After(timestamp) {
+			break
+		}
+		versions[c.Data.indexToKey[diff.KeyIndex]] = diff.Timestamp
+	}
+
+	keyFrame := NewKeyFrame(state)
+	for idx := range keyFrame {
+		keyFrame[idx].Version = versions[keyFrame[idx].Key]
+	}
+	return keyFrame, nil
+}
+
+// LastWrite returns when key was last written in this chunk at or before timestamp.  It
+// returns false if the chunk doesn't know, the write may be in an earlier chunk.
+func (c Chunk) LastWrite(key string, timestamp time.Time) (time.Time, bool) {
+	idx, ok := c.Data.keyToIndex[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	lookup := c.Data.lookup[idx]
+
+	for i := len(lookup.Diffs) - 1; i >= 0; i-- {
+		if diff := c.Data.Diffs[lookup.Diffs[i]]; !diff.Timestamp.After(timestamp) {
+			return diff.Timestamp, true
+		}
+	}
+	if lookup.Frame < 0 {
+		return time.Time{}, false
+	}
+	version := c.frameVersion(c.Data.IndexedKeyFrame[lookup.Frame])
+	if version.IsZero() || version.After(timestamp) {
+		return time.Time{}, false
+	}
+	return version, true
+}
+
+// touched returns the keys in r that the keyframe or a diff up to timestamp sets.  In a
+// chunk that isn't seeded every other key is as the previous chunk left it.
+func (c Chunk) touched(timestamp time.Time, r misc.KeyRange) map[string]bool {
+	keys := map[string]bool{}
+	for _, kv := range c.Data.IndexedKeyFrame {
+		if key := c.Data.indexToKey[kv.KeyIndex]; r.Contains(key) {
+			keys[key] = true
+		}
+	}
+	for _, diff := range c.Data.Diffs {
+		if diff.Timestamp.After(timestamp) {
+			break
+		}
+		if key := c.Data.indexToKey[diff.KeyIndex]; r.Contains(key) {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// frameVersion is when a keyframe entry was written.  A keyframe that isn't seeded only
+// holds the writes made at the chunk's timestamp.
+func (c Chunk) frameVersion(kv IndexedKVPair) time.Time {
+	if !c.Data.Seeded {
+		return c.Data.Timestamp
+	}
+	return kv.Version
+}
+
+// GetValueAt returns the value key had at timestamp, only that key's keyframe entry
+// and diffs since its last full value are applied.  The chunk has already been decoded
+// as a whole.
+func (c Chunk) GetValueAt(timestamp time.Time, key string) ([]byte, bool, error) {
+	idx, ok := c.Data.keyToIndex[key]
+	if !ok {
+		return nil, false, nil
+	}
+	lookup := c.Data.lookup[idx]
+
+	end := sort.Search(len(lookup.Diffs), func(i int) bool {
+		return c.Data.Diffs[lookup.Diffs[i]].Timestamp.After(timestamp)
+	})
+	start := 0
+	for i := end - 1; i >= 0; i-- {
+		if diff := c.Data.Diffs[lookup.Diffs[i]]; diff.IsDelete() || diff.Diff.IsRaw() {
+			start = i
+			break
+		}
+	}
+
+	var value []byte
+	ok = false
+	if start == 0 && lookup.Frame >= 0 {
+		value, ok = c.Data.IndexedKeyFrame[lookup.Frame].Data, true
+	}
+	for _, d := range lookup.Diffs[start:end] {
+		diff := c.Data.Diffs[d]
+		if diff.IsDelete() {
+			value, ok = nil, false
+			continue
+		}
+		n, err := c.frameAt(int(d), value)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "can not apply diff")
+		}
+		value, ok = n, true
+	}
+
+	return value, ok, nil
+}
+
+// GetRangeStateAt returns the state at timestamp limited to the keys in r.  Keys outside
+// of r are never decoded.
+func (c Chunk) GetRangeStateAt(timestamp time.Time, r misc.KeyRange) (map[string][]byte, error) {
+	if key, ok := r.Key(); ok {
+		ret := map[string][]byte{}
+		value, ok, err := c.GetValueAt(timestamp, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ret[key] = value
+		}
+		return ret, nil
+	}
+
+	inRange := make([]bool, len(c.Data.Keys))
+	for idx, k := range c.Data.Keys {
+		inRange[idx] = r.Contains(k)
+	}
+
 	ret := map[string][]byte{}
 	for _, kv := range c.Data.IndexedKeyFrame {
-		ret[c.Data.indexToKey[kv.KeyIndex]] = kv.Data
+		if inRange[kv.KeyIndex] {
+			ret[c.Data.indexToKey[kv.KeyIndex]] = kv.Data
+		}
 	}
 
 	for idx, diff := range c.Data.Diffs {
 		if diff.Timestamp.After(timestamp) {
 			return ret, nil
 		}
-		if c.Data.frames[idx] == nil {
-			n, _ := applyDiff(ret[c.Data.indexToKey[diff.KeyIndex]], diff.Diff)
-			ret[c.Data.indexToKey[diff.KeyIndex]] = n
-			c.Data.frames[idx] = n
-		} else {
-			ret[c.Data.indexToKey[diff.KeyIndex]] = c.Data.frames[idx]
+		if !inRange[diff.KeyIndex] {
+			continue
+		}
+		key := c.Data.indexToKey[diff.KeyIndex]
+		if diff.IsDelete() {
+			delete(ret, key)
+			continue
 		}
+		n, err := c.frameAt(idx, ret[key])
+		if err != nil {
+			return nil, errors.Wrap(err, "can not apply diff")
+		}
+		ret[key] = n
 	}
 
 	return ret, nil
 }
+
+// GetRangeHistory returns the keyframe values of the keys in r followed by every
+// change made to them in this chunk, in timestamp order.
+func (c Chunk) GetRangeHistory(r misc.KeyRange) (map[string][]byte, []Event, error) {
+	if key, ok := r.Key(); ok {
+		return c.getKeyHistory(key)
+	}
+
+	inRange := make([]bool, len(c.Data.Keys))
+	for idx, k := range c.Data.Keys {
+		inRange[idx] = r.Contains(k)
+	}
+
+	values := map[string][]byte{}
+	for _, kv := range c.Data.IndexedKeyFrame {
+		if inRange[kv.KeyIndex] {
+			values[c.Data.indexToKey[kv.KeyIndex]] = kv.Data
+		}
+	}
+	base := misc.DeepCopyMap(values)
+
+	events := []Event{}
+	for idx, diff := range c.Data.Diffs {
+		if !inRange[diff.KeyIndex] {
+			continue
+		}
+		key := c.Data.indexToKey[diff.KeyIndex]
+		if diff.IsDelete() {
+			delete(values, key)
+			events = append(events, Event{Timestamp: diff.Timestamp, Key: key, Delete: true})
+			continue
+		}
+		n, err := c.frameAt(idx, values[key])
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "can not apply diff")
+		}
+		values[key] = n
+		events = append(events, Event{Timestamp: diff.Timestamp, Key: key, Data: n})
+	}
+
+	return base, events, nil
+}
+
+func (c Chunk) getKeyHistory(key string) (map[string][]byte, []Event, error) {
+	base := map[string][]byte{}
+	events := []Event{}
+
+	idx, ok := c.Data.keyToIndex[key]
+	if !ok {
+		return base, events, nil
+	}
+	lookup := c.Data.lookup[idx]
+
+	var value []byte
+	if lookup.Frame >= 0 {
+		value = c.Data.IndexedKeyFrame[lookup.Frame].Data
+		base[key] = value
+	}
+	for _, d := range lookup.Diffs {
+		diff := c.Data.Diffs[d]
+		if diff.IsDelete() {
+			value = nil
+			events = append(events, Event{Timestamp: diff.Timestamp, Key: key, Delete: true})
+			continue
+		}
+		n, err := c.frameAt(int(d), value)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "can not apply diff")
+		}
+		value = n
+		events = append(events, Event{Timestamp: diff.Timestamp, Key: key, Data: n})
+	}
+
+	return base, events, nil
+}
+
+// KeyChange is the value a key held before and after a window of time, a nil value
+// means the key was not set.
+type KeyChange struct {
+	Key    string
+	Before []byte
+	After  []byte
+}
+
+// GetChanges walks the diffs of this chunk and records every key written in (from, to]
+// into changes.  Keys already in changes keep their Before value.
+func (c Chunk) GetChanges(from time.Time, to time.Time, changes map[string]KeyChange) error {
+	var keyFrame map[int32][]byte
+	values := map[int32][]byte{}
+
+	for idx, diff := range c.Data.Diffs {
+		if diff.Timestamp.After(to) {
+			break
+		}
+
+		prev, ok := values[diff.KeyIndex]
+		if !ok {
+			if keyFrame == nil {
+				keyFrame = make(map[int32][]byte, len(c.Data.IndexedKeyFrame))
+				for _, kv := range c.Data.IndexedKeyFrame {
+					keyFrame[kv.KeyIndex] = kv.Data
+				}
+			}
+			prev = keyFrame[diff.KeyIndex]
+		}
+
+		var value []byte
+		if !diff.IsDelete() {
+			n, err := c.frameAt(idx, prev)
+			if err != nil {
+				return errors.Wrap(err, "can not apply diff")
+			}
+			value = n
+		}
+		values[diff.KeyIndex] = value
+
+		if !diff.Timestamp.After(from) {
+			continue
+		}
+		key := c.Data.indexToKey[diff.KeyIndex]
+		change, ok := changes[key]
+		if !ok {
+			change = KeyChange{Key: key, Before: prev}
+		}
+		change.After = value
+		changes[key] = change
+	}
+
+	return nil
+}
+
+// frameAt returns the value produced by applying diff idx to prev, caching the result
+func (c Chunk) frameAt(idx int, prev []byte) ([]byte, error) {
+	f := c.Data.frames
+	f.lock.Lock()
+	n := f.frames[idx]
+	f.lock.Unlock()
+	if n != nil {
+		return n, nil
+	}
+
+	n, err := applyDiff(prev, c.Data.Diffs[idx].Diff)
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	if f.frames[idx] != nil {
+		n = f.frames[idx]
+		f.lock.Unlock()
+		return n, nil
+	}
+	f.frames[idx] = n
+	f.bytes += int64(len(n))
+	grow := f.grow
+	f.lock.Unlock()
+
+	// The cache takes its own lock, never call it holding ours
+	if grow != nil {
+		grow(int64(len(n)))
+	}
+	return n, nil
+}
@@ -5,6 +5,8 @@ import "time"
 // A chunk Id is in the form YYYY/MM/DD/YYYYMMDD_HHMMSS.sssssssss
 // $ChunkId.data would be the key in a storage system to locate a chunks data
 // $ChunkId.header would be the key in a storage system to locate a chunks meta data
+// Chunks written by compaction have the time they were written appended so they never
+// overwrite the chunks they replace.
 type ChunkId string
 
 const layout = "20060102_150405.000000000"
@@ -12,5 +14,19 @@ const layout = "20060102_150405.000000000"
 func NewChunkId(t time.Time) ChunkId {
 	return ChunkId(t.UTC().Format(layout))
 }
+
+func newCompactedChunkId(t time.Time, written time.Time) ChunkId {
+	return ChunkId(t.UTC().Format(layout) + "-" + written.UTC().Format(layout))
+}
+
+// Time returns the time the chunk starts at
+func (c ChunkId) Time() (time.Time, error) {
+	s := string(c)
+	if len(s) > len(layout) {
+		s = s[:len(layout)]
+	}
+	t, err := time.Parse(layout, s)
+	return t.UTC(), err
+}
 func (c ChunkId) HeaderKey() string { return string(c) + ".header" }
 func (c ChunkId) ChunkKey() string  { return string(c) + ".chunk" }
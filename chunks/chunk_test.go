@@ -3,11 +3,16 @@ package chunks
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/errors"
+
 	"github.com/hoyle1974/temporal/storage"
-	"github.com/patrickmn/go-cache"
+	"github.com/hoyle1974/temporal/telemetry"
 )
 
 func TestEmptyChunk(t *testing.T) {
@@ -22,7 +27,7 @@ func TestEmptyChunk(t *testing.T) {
 
 	events := []Event{}
 
-	chunk.Finish(keyFrame, events)
+	chunk.Finish(keyFrame, events, Checkpoints{})
 }
 
 func TestKeyFrameOnly(t *testing.T) {
@@ -39,7 +44,7 @@ func TestKeyFrameOnly(t *testing.T) {
 
 	events := []Event{}
 
-	chunk.Finish(keyFrame, events)
+	chunk.Finish(keyFrame, events, Checkpoints{})
 
 	stateAt, err := chunk.GetStateAt(time.Now())
 	if err != nil {
@@ -55,9 +60,6 @@ func TestKeyFrameOnly(t *testing.T) {
 	mem := storage.NewMemoryStorage()
 	chunk.Save(context.Background(), mem)
 
-	// Reset cache
-	chunkCache = cache.New(time.Minute, time.Minute)
-
 	chunk2, err := chunk.Header.LoadChunk(context.Background(), mem)
 	if err != nil {
 		t.Fatalf("could not load chunk: %v", err)
@@ -90,14 +92,11 @@ func TestEventsOnly(t *testing.T) {
 		{time.Now(), "bar", []byte("foo"), false},
 	}
 
-	chunk.Finish(keyFrame, events)
+	chunk.Finish(keyFrame, events, Checkpoints{})
 
 	mem := storage.NewMemoryStorage()
 	chunk.Save(context.Background(), mem)
 
-	// Reset cache
-	chunkCache = cache.New(time.Minute, time.Minute)
-
 	chunk2, err := chunk.Header.LoadChunk(context.Background(), mem)
 	if err != nil {
 		t.Fatalf("could not load chunk: %v", err)
@@ -124,17 +123,290 @@ func TestKeyFrameAndEvents(t *testing.T) {
 		{time.Now().Add(time.Nanosecond * 4), "bar", []byte{}, true},
 	}
 
-	chunk.Finish(keyFrame, events)
+	chunk.Finish(keyFrame, events, Checkpoints{})
 
 	mem := storage.NewMemoryStorage()
 	chunk.Save(context.Background(), mem)
 
-	// Reset cache
-	chunkCache = cache.New(time.Minute, time.Minute)
-
 	chunk2, err := chunk.Header.LoadChunk(context.Background(), mem)
 	if err != nil {
 		t.Fatalf("could not load chunk: %v", err)
 	}
 	fmt.Println(chunk2)
 }
+
+func TestGetValueAt(t *testing.T) {
+	start := time.Now()
+	chunk := NewChunk(start)
+
+	state := map[string][]byte{}
+	state["foo"] = []byte("bar")
+	state["bar"] = []byte("foo")
+	keyFrame := NewKeyFrame(state)
+
+	events := []Event{
+		{start.Add(time.Second), "foo", []byte("bar1"), false},
+		{start.Add(time.Second * 2), "baz", []byte("foobar"), false},
+		{start.Add(time.Second * 3), "foo", []byte{}, true},
+		{start.Add(time.Second * 4), "foo", []byte("bar2"), false},
+	}
+
+	chunk.Finish(keyFrame, events, Checkpoints{})
+
+	mem := storage.NewMemoryStorage()
+	chunk.Save(context.Background(), mem)
+	chunk2, err := chunk.Header.LoadChunk(context.Background(), mem)
+	if err != nil {
+		t.Fatalf("could not load chunk: %v", err)
+	}
+
+	for idx := range 5 {
+		timestamp := start.Add(time.Second * time.Duration(idx))
+		stateAt, err := chunk2.GetStateAt(timestamp)
+		if err != nil {
+			t.Fatalf("GetStateAt failed: %v", err)
+		}
+		for _, key := range []string{"foo", "bar", "baz", "missing"} {
+			value, ok, err := chunk2.GetValueAt(timestamp, key)
+			if err != nil {
+				t.Fatalf("GetValueAt failed: %v", err)
+			}
+			expected, expectedOk := stateAt[key]
+			if ok != expectedOk || string(value) != string(expected) {
+				t.Fatalf("%s at %d should be %q, got %q", key, idx, expected, value)
+			}
+		}
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	start := time.Now()
+	chunk := NewChunk(start)
+
+	events := []Event{}
+	for idx := range 200 {
+		value := strings.Repeat("a long value that only changes at the end ", 64) + fmt.Sprint(idx)
+		events = append(events, Event{start.Add(time.Second * time.Duration(idx)), "hot", []byte(value), false})
+	}
+
+	chunk.Finish(NewKeyFrame(map[string][]byte{}), events, Checkpoints{Diffs: 16})
+
+	run, raw := 0, 0
+	for _, diff := range chunk.Data.Diffs {
+		if diff.Diff.IsRaw() {
+			run = 0
+			raw++
+			continue
+		}
+		run++
+		if run > 16 {
+			t.Fatalf("more than 16 diffs between full values")
+		}
+	}
+	if raw == len(chunk.Data.Diffs) {
+		t.Fatalf("expected values to be stored as diffs between full values")
+	}
+
+	for idx := range 200 {
+		value, ok, err := chunk.GetValueAt(start.Add(time.Second*time.Duration(idx)), "hot")
+		if err != nil {
+			t.Fatalf("GetValueAt failed: %v", err)
+		}
+		if !ok || string(value) != string(events[idx].Data) {
+			t.Fatalf("hot at %d should be %q, got %q", idx, events[idx].Data, value)
+		}
+	}
+}
+
+func TestDiffCodecs(t *testing.T) {
+	values := [][]byte{
+		[]byte{},
+		[]byte(`{"name":"temporal","count":1,"tags":["a","b"]}`),
+		[]byte(`{"name":"temporal","count":2,"tags":["a","b","c"]}`),
+		[]byte(`{"count":2,"name":"temporal"}`),
+		[]byte(strings.Repeat("a long value that only changes at the end ", 256) + "1"),
+		[]byte(strings.Repeat("a long value that only changes at the end ", 256) + "2"),
+	}
+
+	for _, codec := range []DiffCodec{RawCodec, BsdiffCodec, DeltaCodec, nil} {
+		for idx := 1; idx < len(values); idx++ {
+			diff, err := generateDiff(codec, values[idx-1], values[idx])
+			if err != nil {
+				t.Fatalf("generateDiff failed: %v", err)
+			}
+			value, err := applyDiff(values[idx-1], diff)
+			if err != nil {
+				t.Fatalf("applyDiff failed: %v", err)
+			}
+			if string(value) != string(values[idx]) {
+				t.Fatalf("codec %v: expected %q, got %q", codec, values[idx], value)
+			}
+		}
+	}
+
+	// A small edit to a large value is a small delta
+	diff, err := generateDiff(DeltaCodec, values[4], values[5])
+	if err != nil || diff.IsRaw() || len(diff) > 32 {
+		t.Fatalf("expected a small delta, got %d bytes: %v", len(diff), err)
+	}
+
+	_, err = applyDiff(values[4], Diff{DeltaCodec.Id(), deltaCopy, 0, 200})
+	if err == nil {
+		t.Fatalf("expected a copy past the end of the value to fail")
+	}
+	_, err = applyDiff(values[4], Diff{99})
+	if err == nil {
+		t.Fatalf("expected an unknown codec to fail")
+	}
+
+	// Chunks written with different codecs are all readable
+	start := time.Now()
+	events := []Event{}
+	for idx := range 30 {
+		value := strings.Repeat("x", idx*idx*10) + fmt.Sprint(idx)
+		events = append(events, Event{start.Add(time.Second * time.Duration(idx)), "key", []byte(value), false})
+	}
+	for _, codec := range []DiffCodec{BsdiffCodec, DeltaCodec, nil} {
+		chunk := NewChunk(start)
+		chunk.Finish(NewKeyFrame(map[string][]byte{}), events, Checkpoints{Codec: codec})
+		for idx, e := range events {
+			value, ok, err := chunk.GetValueAt(start.Add(time.Second*time.Duration(idx)), "key")
+			if err != nil || !ok || string(value) != string(e.Data) {
+				t.Fatalf("codec %v: key at %d should be %q, got %q (%v)", codec, idx, e.Data, value, err)
+			}
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	chunkFor := func(id ChunkId, size int) Chunk {
+		return Chunk{Header: Header{Id: id}, Data: ChunkData{Id: id, Keys: []string{strings.Repeat("k", size)}}}
+	}
+
+	cache := NewCache(250, telemetry.NOPMetrics{})
+	ctx := context.Background()
+
+	// Concurrent misses share a single load
+	var loads atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			chunk, err := cache.Load(ctx, "a", func() (Chunk, error) {
+				loads.Add(1)
+				<-release
+				return chunkFor("a", 100), nil
+			})
+			if err != nil || chunk.Header.Id != "a" {
+				t.Errorf("load failed: %v", err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if loads.Load() != 1 {
+		t.Fatalf("expected a single load, have %d", loads.Load())
+	}
+
+	// Failures aren't cached
+	_, err := cache.Load(ctx, "b", func() (Chunk, error) { return Chunk{}, errors.New("failed") })
+	if err == nil {
+		t.Fatalf("expected the load to fail")
+	}
+	_, err = cache.Load(ctx, "b", func() (Chunk, error) { return chunkFor("b", 100), nil })
+	if err != nil {
+		t.Fatalf("expected the second load to succeed: %v", err)
+	}
+
+	// The least recently used chunk is evicted once the budget is reached
+	cache.Load(ctx, "a", nil)
+	cache.Put(chunkFor("c", 100))
+	if cache.Stats().Evictions.Load() != 1 {
+		t.Fatalf("expected an eviction, have %v", cache.Stats())
+	}
+	hits := cache.Stats().Hits.Load()
+	cache.Load(ctx, "a", nil)
+	cache.Load(ctx, "c", nil)
+	if cache.Stats().Hits.Load() != hits+2 {
+		t.Fatalf("expected a and c to be cached, have %v", cache.Stats())
+	}
+	_, err = cache.Load(ctx, "b", func() (Chunk, error) { return Chunk{}, errors.New("evicted") })
+	if err == nil {
+		t.Fatalf("expected b to have been evicted")
+	}
+
+	// Chunks bigger than the budget are never kept
+	cache.Put(chunkFor("d", 1000))
+	_, err = cache.Load(ctx, "d", func() (Chunk, error) { return Chunk{}, errors.New("not cached") })
+	if err == nil {
+		t.Fatalf("expected d not to be cached")
+	}
+
+	// Values decoded while a chunk is cached count against the budget
+	decoded := NewChunk(time.Now())
+	events := []Event{}
+	for idx := range 5 {
+		events = append(events, Event{Timestamp: decoded.Data.Timestamp.Add(time.Second * time.Duration(idx)), Key: fmt.Sprint(idx), Data: []byte(strings.Repeat(fmt.Sprint(idx), 1000))})
+	}
+	decoded.Finish(KeyFrame{}, events, Checkpoints{})
+	cache = NewCache(int64(decoded.Data.RawSize())+1000, telemetry.NOPMetrics{})
+	cache.Put(*decoded)
+	if _, err := decoded.GetStateAt(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("could not decode chunk: %v", err)
+	}
+	if cache.Stats().Evictions.Load() != 1 {
+		t.Fatalf("expected the decoded values to evict the chunk, have %v", cache.Stats())
+	}
+}
+
+func TestUnseededChunks(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	index, err := NewChunkIndex(ctx, s, RetentionPolicy{}, nil, Checkpoints{}, Corruption{}, 1024*1024, telemetry.NOPLogger{}, telemetry.NOPMetrics{})
+	if err != nil {
+		t.Fatalf("could not create index: %v", err)
+	}
+
+	// Chunks written before keyframes were seeded only hold the writes made at their start
+	a := time.Now()
+	for idx, key := range []string{"foo", "bar", "baz", "qux"} {
+		chunk := NewChunk(a.Add(time.Second * time.Duration(idx)))
+		events := []Event{}
+		if key == "qux" {
+			events = append(events, Event{Timestamp: a.Add(time.Millisecond * 3500), Key: "foo", Delete: true})
+		}
+		chunk.Finish(KeyFrame{{Key: key, Data: []byte(key)}}, events, Checkpoints{})
+		if err := chunk.Save(ctx, s); err != nil {
+			t.Fatalf("could not save chunk: %v", err)
+		}
+		if err := index.UpdateIndex(ctx, chunk.Header); err != nil {
+			t.Fatalf("could not update index: %v", err)
+		}
+	}
+
+	state, err := index.GetStateAt(ctx, a.Add(time.Second*2))
+	if err != nil || fmt.Sprint(state) != fmt.Sprint(map[string][]byte{"foo": []byte("foo"), "bar": []byte("bar"), "baz": []byte("baz")}) {
+		t.Fatalf("expected the keys of the earlier chunks, have %v %v", state, err)
+	}
+	value, err := index.GetValueAt(ctx, a.Add(time.Second*2), "foo")
+	if err != nil || string(value) != "foo" {
+		t.Fatalf("expected foo, have %q %v", value, err)
+	}
+
+	// A delete in a later chunk hides the value from the earlier one
+	value, err = index.GetValueAt(ctx, a.Add(time.Second*4), "foo")
+	if err != nil || value != nil {
+		t.Fatalf("expected foo to be deleted, have %q %v", value, err)
+	}
+	keyFrame, err := index.GetKeyFrameAt(ctx, a.Add(time.Second*4))
+	if err != nil || len(keyFrame) != 3 || keyFrame[0].Key != "bar" || !keyFrame[0].Version.Equal(a.Add(time.Second)) {
+		t.Fatalf("wrong keyframe: %+v %v", keyFrame, err)
+	}
+	version, err := index.LastWrite(ctx, "foo", a.Add(time.Second*4))
+	if err != nil || !version.Equal(a.Add(time.Millisecond*3500)) {
+		t.Fatalf("wrong version: %v %v", version, err)
+	}
+}
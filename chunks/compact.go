@@ -0,0 +1,254 @@
+package chunks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/hoyle1974/temporal/misc"
+)
+
+var errIndexChanged = errors.New("index changed during compaction")
+
+// Compact merges runs of adjacent chunks smaller than minSize into chunks of up to
+// targetSize.  Each merged chunk is saved and linked into the index before the chunks
+// it replaces are deleted.  It returns how many chunks were removed from the index.
+func (ci *index) Compact(ctx context.Context, minSize int64, targetSize int64, checkpoints Checkpoints) (int, error) {
+	groups, err := ci.planCompaction(ctx, minSize, targetSize)
+	if err != nil {
+		return 0, errors.Wrap(err, "can not plan compaction")
+	}
+
+	removed := 0
+	for _, group := range groups {
+		merged, err := mergeChunks(ctx, ci, group, checkpoints)
+		if err != nil {
+			return removed, errors.Wrap(err, "can not merge chunks")
+		}
+
+		err = merged.Save(ctx, ci.storage)
+		if err != nil {
+			return removed, errors.Wrap(err, "can not save merged chunk")
+		}
+
+		err = ci.replaceHeaders(ctx, group, merged.Header)
+		if errors.Is(err, errIndexChanged) {
+			merged.Header.RemoveFromStorage(context.WithoutCancel(ctx), ci.storage)
+			continue
+		}
+		if err != nil {
+			return removed, errors.Wrap(err, "can not replace headers")
+		}
+
+		// Nothing refers to the old chunks anymore
+		for _, h := range group {
+			ci.cache.Remove(h.Id)
+			err := h.RemoveFromStorage(context.WithoutCancel(ctx), ci.storage)
+			if err != nil {
+				ci.logger.Error(fmt.Sprintf("can not remove compacted chunk %s", h.Id), err)
+			}
+		}
+		removed += len(group) - 1
+		ci.logger.Debug(fmt.Sprintf("Compacted %d chunks into %s", len(group), merged.Header.Id))
+	}
+
+	return removed, nil
+}
+
+// planCompaction groups adjacent chunks that are smaller than minSize, each group stays
+// within targetSize.  Groups of a single chunk are left alone.
+func (ci *index) planCompaction(ctx context.Context, minSize int64, targetSize int64) ([][]Header, error) {
+	ci.lock.Lock()
+	headers := append([]Header{}, ci.headers...)
+	ci.lock.Unlock()
+
+	groups := [][]Header{}
+	group := []Header{}
+	var groupSize int64
+	flush := func() {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+		group = []Header{}
+		groupSize = 0
+	}
+
+	for _, h := range headers {
+		size, err := ci.chunkSize(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		if size >= minSize {
+			flush()
+			continue
+		}
+		if groupSize+size > targetSize {
+			flush()
+		}
+		group = append(group, h)
+		groupSize += size
+	}
+	flush()
+
+	return groups, nil
+}
+
+func (ci *index) chunkSize(ctx context.Context, h Header) (int64, error) {
+	if h.Size > 0 {
+		return h.Size, nil
+	}
+
+	// Chunks written before the size was recorded have to be looked at
+	chunk, err := h.LoadChunk(ctx, ci.storage)
+	if err != nil {
+		return 0, errors.Wrap(err, "can not load chunk")
+	}
+	if size := chunk.Data.GetDiskSize(); size > 0 {
+		return int64(size), nil
+	}
+	return chunk.EstimateSize()
+}
+
+// mergeChunks builds a single chunk holding everything in the adjacent chunks of group
+func mergeChunks(ctx context.Context, ci *index, group []Header, checkpoints Checkpoints) (*Chunk, error) {
+	var first Chunk
+	state := map[string][]byte{}
+	events := []Event{}
+
+	for idx, h := range group {
+		chunk, err := ci.loadChunk(ctx, h)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not load chunk")
+		}
+		keyFrame, chunkEvents, err := chunk.GetRangeHistory(misc.KeyRange{})
+		if err != nil {
+			return nil, errors.Wrap(err, "can not read chunk")
+		}
+
+		if idx == 0 {
+			first = chunk
+			for k, v := range keyFrame {
+				state[k] = v
+			}
+		} else {
+			// A later keyframe only says something new where it differs from where the
+			// previous chunk left off
+			for k, v := range misc.Range(keyFrame) {
+				if old, ok := state[k]; !ok || !bytes.Equal(old, v) {
+					events = append(events, Event{Timestamp: chunk.Data.Timestamp, Key: k, Data: v})
+					state[k] = v
+				}
+			}
+			if chunk.Data.Seeded {
+				for k := range misc.Range(state) {
+					if _, ok := keyFrame[k]; !ok {
+						events = append(events, Event{Timestamp: chunk.Data.Timestamp, Key: k, Delete: true})
+						delete(state, k)
+					}
+				}
+			}
+		}
+
+		for _, e := range chunkEvents {
+			events = append(events, e)
+			e.Apply(state)
+		}
+	}
+
+	// The merged chunk is only as coarse as the finest chunk in it
+	bucket := group[0].Bucket
+	for _, h := range group {
+		bucket = min(bucket, h.Bucket)
+	}
+
+	last := group[len(group)-1]
+	id := newCompactedChunkId(first.Data.Timestamp, time.Now())
+	merged := &Chunk{
+		Header: Header{
+			LastUpdate: time.Now().UTC(),
+			Id:         id,
+			Prev:       group[0].Prev,
+			Next:       last.Next,
+			Min:        group[0].Min,
+			Max:        last.Max,
+			Bucket:     bucket,
+		},
+		Data: ChunkData{
+			Id:        id,
+			Timestamp: first.Data.Timestamp,
+			Seeded:    first.Data.Seeded,
+		},
+	}
+	merged.Finish(first.KeyFrame(), events, checkpoints)
+
+	return merged, nil
+}
+
+// replaceHeaders swaps the headers in group for merged and relinks its neighbours
+func (ci *index) replaceHeaders(ctx context.Context, group []Header, merged Header) error {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	err := ci.replaceHeadersLocked(ctx, group, merged)
+	if err != nil {
+		return err
+	}
+	return ci.saveManifest(ctx)
+}
+
+// replaceHeadersLocked is replaceHeaders for a caller that holds the lock, it doesn't
+// save the manifest
+func (ci *index) replaceHeadersLocked(ctx context.Context, group []Header, merged Header) error {
+	start := -1
+	for idx, h := range ci.headers {
+		if h.Id == group[0].Id {
+			start = idx
+			break
+		}
+	}
+	if start < 0 || start+len(group) > len(ci.headers) {
+		return errIndexChanged
+	}
+	for idx, h := range group {
+		if ci.headers[start+idx].Id != h.Id {
+			return errIndexChanged
+		}
+	}
+
+	headers := append([]Header{}, ci.headers[:start]...)
+	headers = append(headers, merged)
+	headers = append(headers, ci.headers[start+len(group):]...)
+
+	// The merged header was saved with the right links, its neighbours need to point at it
+	merged.Prev, merged.Next = "", ""
+	if start > 0 {
+		headers[start-1].Next = merged.Id
+		merged.Prev = headers[start-1].Id
+		err := headers[start-1].Save(ctx, ci.storage)
+		if err != nil {
+			return errors.Wrap(err, "can not save header")
+		}
+	}
+	if start+1 < len(headers) {
+		headers[start+1].Prev = merged.Id
+		merged.Next = headers[start+1].Id
+		err := headers[start+1].Save(ctx, ci.storage)
+		if err != nil {
+			return errors.Wrap(err, "can not save header")
+		}
+	}
+	headers[start] = merged
+
+	if start == 0 {
+		err := ci.storage.Write(ctx, "start.idx", []byte(merged.Id))
+		if err != nil {
+			return errors.Wrap(err, "can not write start.idx")
+		}
+	}
+
+	ci.headers = headers
+	return nil
+}
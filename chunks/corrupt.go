@@ -0,0 +1,202 @@
+package chunks
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ErrCorrupt matches every CorruptError
+var ErrCorrupt = errors.New("corrupt chunk")
+
+// CorruptError is returned when a chunk or header fails its checksum or can't be decoded
+type CorruptError struct {
+	Id  ChunkId
+	Err error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("chunk %s is corrupt: %v", e.Id, e.Err)
+}
+
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+var errUnreadable = errors.New("marked unreadable")
+
+// CorruptionMode decides what the index does when it finds a corrupt chunk
+type CorruptionMode int
+
+const (
+	FailOnCorrupt       CorruptionMode = iota // Return the error every time the chunk is read
+	RebuildCorrupt                            // Rebuild the chunk from the events it was built from
+	UnreadableOnCorrupt                       // Mark the chunk's time range unreadable so it isn't loaded again
+)
+
+// EventSource returns the events logged between from and to (inclusive)
+type EventSource func(ctx context.Context, from time.Time, to time.Time) ([]Event, error)
+
+// EventRelease lets go of the events logged before a time, no chunk needs them anymore
+type EventRelease func(ctx context.Context, before time.Time) error
+
+// Corruption is what the index does when a chunk it loads is corrupt.  Events and
+// Release are only used by RebuildCorrupt.
+type Corruption struct {
+	Mode    CorruptionMode
+	Events  EventSource
+	Release EventRelease // Called when retention removes the oldest chunks, may be nil
+}
+
+// loadChunk loads the chunk for h, applying the corruption policy if it is corrupt
+func (ci *index) loadChunk(ctx context.Context, h Header) (Chunk, error) {
+	if h.Unreadable {
+		return Chunk{}, &CorruptError{Id: h.Id, Err: errUnreadable}
+	}
+
+	chunk, err := ci.cache.Load(ctx, h.Id, func() (Chunk, error) {
+		return h.LoadChunk(ctx, ci.storage)
+	})
+	if !errors.Is(err, ErrCorrupt) {
+		return chunk, err
+	}
+	ci.logger.Error(fmt.Sprintf("chunk %s is corrupt", h.Id), err)
+
+	switch ci.corruption.Mode {
+	case RebuildCorrupt:
+		rebuilt, rebuildErr := ci.rebuildChunk(ctx, h)
+		if rebuildErr != nil {
+			ci.logger.Error(fmt.Sprintf("can not rebuild chunk %s", h.Id), rebuildErr)
+			return Chunk{}, err
+		}
+		return rebuilt, nil
+	case UnreadableOnCorrupt:
+		markErr := ci.markUnreadable(ctx, h)
+		if markErr != nil {
+			ci.logger.Error(fmt.Sprintf("can not mark chunk %s unreadable", h.Id), markErr)
+		}
+	}
+	return Chunk{}, err
+}
+
+// rebuildChunk builds h's chunk again from the events in its time range, seeded with the
+// state the chunk before it ended with, and saves it under the same id
+func (ci *index) rebuildChunk(ctx context.Context, h Header) (Chunk, error) {
+	if ci.corruption.Events == nil {
+		return Chunk{}, errors.New("no event source to rebuild from")
+	}
+
+	ci.lock.Lock()
+	idx := ci.position(h.Id)
+	var prev Header
+	if idx > 0 {
+		prev = ci.headers[idx-1]
+	}
+	ci.lock.Unlock()
+	if idx < 0 {
+		return Chunk{}, errIndexChanged
+	}
+
+	keyFrame := KeyFrame{}
+	if prev.Id != "" {
+		prevChunk, err := ci.loadChunk(ctx, prev)
+		if err != nil {
+			return Chunk{}, errors.Wrap(err, "can not load previous chunk")
+		}
+		keyFrame, err = prevChunk.GetKeyFrameAt(prev.Max)
+		if err != nil {
+			return Chunk{}, errors.Wrap(err, "can not get previous state")
+		}
+	}
+
+	events, err := ci.corruption.Events(ctx, h.Min, h.Max)
+	if err != nil {
+		return Chunk{}, errors.Wrap(err, "can not get events")
+	}
+	if len(events) == 0 {
+		return Chunk{}, errors.New("no events logged for the chunk")
+	}
+
+	header := h
+	header.LastUpdate = time.Now().UTC()
+	header.Bucket = 0
+	header.Dropped = nil
+	chunk := &Chunk{
+		Header: header,
+		Data:   ChunkData{Id: h.Id, Timestamp: h.Min, Seeded: true},
+	}
+	chunk.Finish(keyFrame, events, ci.checkpoints)
+
+	// The logs hold every event, so filter them the way the chunk was
+	if len(h.Dropped) > 0 {
+		chunk, err = dropPrefixes(*chunk, h.Dropped, ci.checkpoints)
+		if err != nil {
+			return Chunk{}, errors.Wrap(err, "can not drop prefixes")
+		}
+	}
+	if h.Bucket > 0 {
+		chunk, err = downsampleChunk(*chunk, h.Bucket, ci.checkpoints)
+		if err != nil {
+			return Chunk{}, errors.Wrap(err, "can not downsample")
+		}
+	}
+	chunk.Header.Id = h.Id
+	chunk.Data.Id = h.Id
+
+	err = chunk.Save(ctx, ci.storage)
+	if err != nil {
+		return Chunk{}, errors.Wrap(err, "can not save rebuilt chunk")
+	}
+
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	idx = ci.position(h.Id)
+	if idx < 0 {
+		return Chunk{}, errIndexChanged
+	}
+	ci.headers[idx] = chunk.Header
+	err = ci.saveManifest(ctx)
+	if err != nil {
+		return Chunk{}, err
+	}
+	ci.cache.Put(*chunk)
+
+	ci.logger.Info(fmt.Sprintf("Rebuilt chunk %s from %d events", h.Id, len(events)))
+	return *chunk, nil
+}
+
+// markUnreadable records that h's chunk is corrupt so reads in its range fail without
+// loading it
+func (ci *index) markUnreadable(ctx context.Context, h Header) error {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	idx := ci.position(h.Id)
+	if idx < 0 {
+		return errIndexChanged
+	}
+	ci.headers[idx].Unreadable = true
+
+	// The header itself may be what is corrupt, the manifest still has the flag
+	err := ci.headers[idx].Save(ctx, ci.storage)
+	if err != nil {
+		ci.logger.Error(fmt.Sprintf("can not save header %s", h.Id), err)
+	}
+	return ci.saveManifest(ctx)
+}
+
+// position returns where id is in the index or -1, the caller must hold the lock
+func (ci *index) position(id ChunkId) int {
+	for idx, h := range ci.headers {
+		if h.Id == id {
+			return idx
+		}
+	}
+	return -1
+}
@@ -1,26 +1,99 @@
 package chunks
 
 import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
 	"github.com/cockroachdb/errors"
 	"github.com/gabstv/go-bsdiff/pkg/bsdiff"
 	"github.com/gabstv/go-bsdiff/pkg/bspatch"
 )
 
+// The first byte of a diff says which codec made it, an empty diff is a delete
 type Diff []byte
 
-func generateDiff(a, b []byte) (Diff, error) {
-	patch, err := bsdiff.Bytes(a, b)
+// DiffCodec turns one value into the next.  Id is written as the first byte of every diff
+// the codec makes so it has to be unique and can never change.
+type DiffCodec interface {
+	Id() byte
+	Diff(a, b []byte) ([]byte, error)
+	Patch(a, patch []byte) ([]byte, error)
+}
+
+var (
+	RawCodec    DiffCodec = rawCodec{}    // Stores the whole value
+	BsdiffCodec DiffCodec = bsdiffCodec{} // Small diffs, but slow to make
+	DeltaCodec  DiffCodec = deltaCodec{}  // Copy/insert delta, fast and good at small edits
+)
+
+var (
+	diffCodecLock sync.RWMutex
+	diffCodecs    = map[byte]DiffCodec{}
+)
+
+func init() {
+	RegisterDiffCodec(RawCodec)
+	RegisterDiffCodec(BsdiffCodec)
+	RegisterDiffCodec(DeltaCodec)
+}
+
+// RegisterDiffCodec makes diffs written by codec readable, it panics if the id is taken
+func RegisterDiffCodec(codec DiffCodec) {
+	diffCodecLock.Lock()
+	defer diffCodecLock.Unlock()
+	if _, ok := diffCodecs[codec.Id()]; ok {
+		panic(fmt.Sprintf("diff codec %d registered twice", codec.Id()))
+	}
+	diffCodecs[codec.Id()] = codec
+}
+
+// CheckDiffCodec returns an error if codec isn't registered, so what it writes couldn't
+// be read back
+func CheckDiffCodec(codec DiffCodec) error {
+	diffCodecLock.RLock()
+	defer diffCodecLock.RUnlock()
+	if _, ok := diffCodecs[codec.Id()]; !ok {
+		return errors.Errorf("diff codec %d is not registered", codec.Id())
+	}
+	return nil
+}
+
+// Values up to this size are diffed with DeltaCodec when no codec is chosen, bsdiff only
+// pays for itself on larger values
+const smallValueSize = 4 * 1024
+
+func codecFor(b []byte) DiffCodec {
+	if len(b) <= smallValueSize {
+		return DeltaCodec
+	}
+	return BsdiffCodec
+}
+
+// A raw diff holds the whole value, it doesn't depend on anything before it
+func (d Diff) IsRaw() bool {
+	return len(d) > 0 && d[0] == RawCodec.Id()
+}
+
+func rawDiff(b []byte) Diff {
+	return append([]byte{RawCodec.Id()}, b...)
+}
+
+// generateDiff diffs a and b with codec, or one picked for the size of b if it is nil
+func generateDiff(codec DiffCodec, a, b []byte) (Diff, error) {
+	if codec == nil {
+		codec = codecFor(b)
+	}
+	patch, err := codec.Diff(a, b)
 	if err != nil {
 		return Diff{}, errors.Wrap(err, "can not generate diff")
 	}
 
-	if len(patch) >= len(b) {
-		// Store raw data with a "0" prefix
-		return append([]byte{0}, b...), nil
+	if codec.Id() != RawCodec.Id() && len(patch) >= len(b) {
+		return rawDiff(b), nil
 	}
 
-	// Store diff with a "1" prefix
-	return append([]byte{1}, patch...), nil
+	return append([]byte{codec.Id()}, patch...), nil
 }
 
 func applyDiff(a []byte, diffData Diff) ([]byte, error) {
@@ -28,19 +101,124 @@ func applyDiff(a []byte, diffData Diff) ([]byte, error) {
 		return a, nil
 	}
 
-	// Check prefix
-	switch diffData[0] {
-	case 0:
-		// Raw data case
-		return diffData[1:], nil
-	case 1:
-		// Diff case
-		newfile, err := bspatch.Bytes(a, diffData[1:])
-		if err != nil {
-			return []byte{}, errors.Wrap(err, "can not apply diff")
+	diffCodecLock.RLock()
+	codec, ok := diffCodecs[diffData[0]]
+	diffCodecLock.RUnlock()
+	if !ok {
+		return []byte{}, errors.Errorf("invalid diff format %d", diffData[0])
+	}
+	b, err := codec.Patch(a, diffData[1:])
+	if err != nil {
+		return []byte{}, errors.Wrap(err, "can not apply diff")
+	}
+	return b, nil
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Id() byte                              { return 0 }
+func (rawCodec) Diff(a, b []byte) ([]byte, error)      { return b, nil }
+func (rawCodec) Patch(a, patch []byte) ([]byte, error) { return patch, nil }
+
+type bsdiffCodec struct{}
+
+func (bsdiffCodec) Id() byte                              { return 1 }
+func (bsdiffCodec) Diff(a, b []byte) ([]byte, error)      { return bsdiff.Bytes(a, b) }
+func (bsdiffCodec) Patch(a, patch []byte) ([]byte, error) { return bspatch.Bytes(a, patch) }
+
+// deltaCodec writes b as a list of inserts of new bytes and copies of runs from a.  Runs
+// are found by looking up every deltaBlock bytes of b in an index of a.
+type deltaCodec struct{}
+
+const (
+	deltaBlock  = 8
+	deltaInsert = 0
+	deltaCopy   = 1
+)
+
+func (deltaCodec) Id() byte { return 2 }
+
+func (deltaCodec) Diff(a, b []byte) ([]byte, error) {
+	blocks := map[uint64]int{}
+	for i := 0; i+deltaBlock <= len(a); i += deltaBlock {
+		k := binary.LittleEndian.Uint64(a[i:])
+		if _, ok := blocks[k]; !ok {
+			blocks[k] = i
+		}
+	}
+
+	out := []byte{}
+	insert := func(data []byte) {
+		if len(data) > 0 {
+			out = append(out, deltaInsert)
+			out = binary.AppendUvarint(out, uint64(len(data)))
+			out = append(out, data...)
+		}
+	}
+
+	pending := 0 // Start of the bytes that haven't been written yet
+	i := 0
+	for i+deltaBlock <= len(b) {
+		off, ok := blocks[binary.LittleEndian.Uint64(b[i:])]
+		if !ok {
+			i++
+			continue
+		}
+
+		// Grow the match in both directions
+		start, src := i, off
+		for start > pending && src > 0 && a[src-1] == b[start-1] {
+			start--
+			src--
+		}
+		end, srcEnd := i+deltaBlock, off+deltaBlock
+		for end < len(b) && srcEnd < len(a) && a[srcEnd] == b[end] {
+			end++
+			srcEnd++
+		}
+
+		insert(b[pending:start])
+		out = append(out, deltaCopy)
+		out = binary.AppendUvarint(out, uint64(src))
+		out = binary.AppendUvarint(out, uint64(end-start))
+		i, pending = end, end
+	}
+	insert(b[pending:])
+
+	return out, nil
+}
+
+var errBadDelta = errors.New("invalid delta")
+
+func (deltaCodec) Patch(a, patch []byte) ([]byte, error) {
+	out := []byte{}
+	for len(patch) > 0 {
+		op := patch[0]
+		patch = patch[1:]
+		switch op {
+		case deltaInsert:
+			n, size := binary.Uvarint(patch)
+			if size <= 0 || uint64(len(patch)-size) < n {
+				return nil, errBadDelta
+			}
+			patch = patch[size:]
+			out = append(out, patch[:n]...)
+			patch = patch[n:]
+		case deltaCopy:
+			off, size := binary.Uvarint(patch)
+			if size <= 0 {
+				return nil, errBadDelta
+			}
+			patch = patch[size:]
+			n, size := binary.Uvarint(patch)
+			if size <= 0 || off > uint64(len(a)) || uint64(len(a))-off < n {
+				return nil, errBadDelta
+			}
+			patch = patch[size:]
+			out = append(out, a[off:off+n]...)
+		default:
+			return nil, errBadDelta
 		}
-		return newfile, nil
-	default:
-		return []byte{}, errors.Errorf("invalid diff format")
 	}
+	return out, nil
 }
@@ -0,0 +1,146 @@
+package chunks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/hoyle1974/temporal/misc"
+)
+
+// DownsamplePolicy keeps a single version per key per Bucket in chunks that ended more
+// than Age before the newest data in the index
+type DownsamplePolicy struct {
+	Age    time.Duration
+	Bucket time.Duration
+}
+
+// bucketFor returns the coarsest bucket of the policies that apply to data of this age
+func bucketFor(policies []DownsamplePolicy, age time.Duration) time.Duration {
+	var bucket time.Duration
+	for _, p := range policies {
+		if age >= p.Age && p.Bucket > bucket {
+			bucket = p.Bucket
+		}
+	}
+	return bucket
+}
+
+// Downsample rewrites the chunks that policies apply to so each key keeps only the last
+// value written in each bucket, at the start of the bucket.  Chunks already downsampled
+// to at least that bucket are left alone.  It returns how many chunks were rewritten.
+func (ci *index) Downsample(ctx context.Context, policies []DownsamplePolicy, checkpoints Checkpoints) (int, error) {
+	ci.lock.Lock()
+	headers := append([]Header{}, ci.headers...)
+	maxTime := ci.maxTime
+	ci.lock.Unlock()
+
+	rewritten := 0
+	for _, h := range headers {
+		bucket := bucketFor(policies, maxTime.Sub(h.Max))
+		if bucket <= h.Bucket {
+			continue
+		}
+
+		chunk, err := ci.loadChunk(ctx, h)
+		if err != nil {
+			return rewritten, errors.Wrap(err, "can not load chunk")
+		}
+		downsampled, err := downsampleChunk(chunk, bucket, checkpoints)
+		if err != nil {
+			return rewritten, errors.Wrap(err, "can not downsample chunk")
+		}
+
+		err = downsampled.Save(ctx, ci.storage)
+		if err != nil {
+			return rewritten, errors.Wrap(err, "can not save downsampled chunk")
+		}
+
+		err = ci.replaceHeaders(ctx, []Header{h}, downsampled.Header)
+		if errors.Is(err, errIndexChanged) {
+			downsampled.Header.RemoveFromStorage(context.WithoutCancel(ctx), ci.storage)
+			continue
+		}
+		if err != nil {
+			return rewritten, errors.Wrap(err, "can not replace header")
+		}
+
+		ci.cache.Remove(h.Id)
+		err = h.RemoveFromStorage(context.WithoutCancel(ctx), ci.storage)
+		if err != nil {
+			ci.logger.Error(fmt.Sprintf("can not remove downsampled chunk %s", h.Id), err)
+		}
+		rewritten++
+	}
+
+	return rewritten, nil
+}
+
+func downsampleChunk(chunk Chunk, bucket time.Duration, checkpoints Checkpoints) (*Chunk, error) {
+	keyFrame, events, err := chunk.GetRangeHistory(misc.KeyRange{})
+	if err != nil {
+		return nil, errors.Wrap(err, "can not read chunk")
+	}
+
+	type slot struct {
+		bucket time.Time
+		key    string
+	}
+
+	// Events are in timestamp order so slots are found in bucket order
+	start := chunk.Data.Timestamp
+	latest := map[slot]Event{}
+	order := []slot{}
+	for _, e := range events {
+		b := e.Timestamp.Truncate(bucket)
+		if b.Before(start) {
+			b = start
+		}
+		s := slot{bucket: b, key: e.Key}
+		if _, ok := latest[s]; !ok {
+			order = append(order, s)
+		}
+		latest[s] = e
+	}
+
+	// Drop whatever leaves the key as it was at the start of the bucket
+	state := misc.DeepCopyMap(keyFrame)
+	kept := make([]Event, 0, len(order))
+	for _, s := range order {
+		e := latest[s]
+		e.Timestamp = s.bucket
+		old, ok := state[e.Key]
+		if e.Delete {
+			if !ok {
+				continue
+			}
+			delete(state, e.Key)
+		} else {
+			if ok && bytes.Equal(old, e.Data) {
+				continue
+			}
+			state[e.Key] = e.Data
+		}
+		kept = append(kept, e)
+	}
+
+	header := chunk.Header
+	header.Id = newCompactedChunkId(start, time.Now())
+	header.LastUpdate = time.Now().UTC()
+	header.Bucket = bucket
+
+	downsampled := &Chunk{
+		Header: header,
+		Data: ChunkData{
+			Id:        header.Id,
+			Timestamp: start,
+			Seeded:    chunk.Data.Seeded,
+		},
+	}
+	downsampled.Finish(chunk.KeyFrame(), kept, checkpoints)
+
+	return downsampled, nil
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/hoyle1974/temporal/misc"
 	"github.com/hoyle1974/temporal/storage"
-	"github.com/patrickmn/go-cache"
 )
 
 // This reprsents a chunk of data that would be stored on disk
@@ -19,6 +18,10 @@ type Header struct {
 	Next       ChunkId
 	Min        time.Time
 	Max        time.Time
+	Size       int64         // Encoded size of the chunk, 0 for chunks written before it was recorded
+	Bucket     time.Duration // The chunk only has one version per key per Bucket, 0 if it has every version
+	Dropped    []string      // Key prefixes retention has removed from the chunk
+	Unreadable bool          // The chunk is corrupt and its time range can't be read
 }
 
 // Loads a header from the storage system
@@ -27,10 +30,11 @@ func LoadHeader(ctx context.Context, s storage.System, id ChunkId) (Header, erro
 	if b, err := s.Read(ctx, id.HeaderKey()); err != nil {
 		return h, errors.Wrap(err, "LoadHeader: can not load header")
 	} else if b == nil {
-		return h, errors.New("LoadHeader: header is empty")
-	} else {
-		return h, misc.DecodeFromBytes(b, &h) // This might come to bite me in the future
+		return h, &CorruptError{Id: id, Err: errors.New("header is empty")}
+	} else if err := misc.DecodeFromBytes(b, &h); err != nil {
+		return h, &CorruptError{Id: id, Err: err}
 	}
+	return h, nil
 }
 
 func (h Header) ResponsibleFor(timestamp time.Time) bool {
@@ -76,31 +80,32 @@ func (h Header) Save(ctx context.Context, s storage.System) error {
 
 // Loads the chunk associated with this header
 func (h Header) LoadChunk(ctx context.Context, s storage.System) (Chunk, error) {
-	if chunk, ok := chunkCache.Get(string(h.Id)); ok {
-		chunkCacheStats.Hit()
-		return chunk.(Chunk), nil
-	} else {
-		chunkCacheStats.Miss()
+	if err := ctx.Err(); err != nil {
+		return Chunk{}, errors.Wrap(err, "can not load chunk")
 	}
-
 	var cd ChunkData
 	b, err := s.Read(ctx, h.Id.ChunkKey())
 	if err != nil {
-		chunkCache.Set(string(h.Id), Chunk{}, cache.DefaultExpiration)
 		return Chunk{}, err
 	}
 	cd.diskSize = len(b)
+	if h.Size > 0 && int64(len(b)) != h.Size {
+		return Chunk{}, &CorruptError{Id: h.Id, Err: errors.Newf("expected %d bytes, read %d", h.Size, len(b))}
+	}
 
-	err = misc.DecodeFromBytes(b, &cd) // This might come to bite me in the future
-	if err != nil {
-		chunkCache.Set(string(h.Id), Chunk{}, cache.DefaultExpiration)
+	if err := ctx.Err(); err != nil {
 		return Chunk{}, errors.Wrap(err, "can not decode chunk")
 	}
 
-	cd.populateNonSerializedData()
+	err = misc.DecodeFromBytes(b, &cd)
+	if err != nil {
+		return Chunk{}, &CorruptError{Id: h.Id, Err: err}
+	}
+	if cd.Id != h.Id {
+		return Chunk{}, &CorruptError{Id: h.Id, Err: errors.Newf("chunk holds %s", cd.Id)}
+	}
 
-	chunk := Chunk{Header: h, Data: cd}
-	chunkCache.Set(string(h.Id), chunk, cache.DefaultExpiration)
+	cd.populateNonSerializedData()
 
-	return chunk, nil
+	return Chunk{Header: h, Data: cd}, nil
 }
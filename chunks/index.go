@@ -1,6 +1,7 @@
 package chunks
 
 import (
+	"bytes"
 	"context"
 	"sort"
 	"sync"
@@ -13,63 +14,100 @@ import (
 )
 
 type Index interface {
-	UpdateIndex(header Header) error
+	UpdateIndex(ctx context.Context, header Header) error
 	findHeaderResponsibleFor(timestamp time.Time) (Header, error)
-	GetStateAt(timestamp time.Time) (map[string][]byte, error)
+	GetStateAt(ctx context.Context, timestamp time.Time) (map[string][]byte, error)
+	GetKeyFrameAt(ctx context.Context, timestamp time.Time) (KeyFrame, error)
+	LastWrite(ctx context.Context, key string, timestamp time.Time) (time.Time, error)
+	GetRangeStateAt(ctx context.Context, timestamp time.Time, r misc.KeyRange) (map[string][]byte, error)
+	GetValueAt(ctx context.Context, timestamp time.Time, key string) ([]byte, error)
+	GetRangeHistory(ctx context.Context, r misc.KeyRange, from time.Time, to time.Time) ([]Event, error)
+	GetChanges(ctx context.Context, from time.Time, to time.Time) (map[string]KeyChange, error)
 	GetMinTime() time.Time
 	GetMaxTime() time.Time
 	GetHeaders() []Header
+	Compact(ctx context.Context, minSize int64, targetSize int64, checkpoints Checkpoints) (int, error)
+	Downsample(ctx context.Context, policies []DownsamplePolicy, checkpoints Checkpoints) (int, error)
+	ApplyRetention(ctx context.Context, policy RetentionPolicy, dryRun bool) (RetentionReport, error)
 }
 
 // The chunk index manages all the chunks
 type index struct {
 	_           misc.NoCopy
-	lock        sync.Mutex
+	lock        sync.RWMutex
 	storage     storage.System
 	headers     []Header
 	minTime     time.Time
 	maxTime     time.Time
-	maxChunkAge time.Duration
+	retention   RetentionPolicy // Applied every time a chunk is added
+	archive     storage.System  // Chunks are copied here before retention removes them, may be nil
+	checkpoints Checkpoints
+	corruption  Corruption
+	cache       *Cache
 	metrics     telemetry.Metrics
 	logger      telemetry.Logger
+	version     uint64 // Version of the last manifest written
 }
 
-func NewChunkIndex(s storage.System, maxChunkAge time.Duration, logger telemetry.Logger, metrics telemetry.Metrics) (Index, error) {
+// The manifest lists every header so the index can be loaded with a single read, the
+// linked list of headers is only walked if it is missing
+const manifestKey = "manifest.idx"
+
+type manifest struct {
+	Version uint64
+	Headers []Header
+}
+
+func NewChunkIndex(ctx context.Context, s storage.System, retention RetentionPolicy, archive storage.System, checkpoints Checkpoints, corruption Corruption, cacheBytes int64, logger telemetry.Logger, metrics telemetry.Metrics) (Index, error) {
 	logger.Info("NewChunkIndex")
 	ci := &index{
 		storage:     s,
 		headers:     []Header{},
-		maxChunkAge: maxChunkAge,
+		retention:   retention,
+		archive:     archive,
+		checkpoints: checkpoints,
+		corruption:  corruption,
+		cache:       NewCache(cacheBytes, metrics),
 		metrics:     metrics,
 		logger:      logger,
 	}
 
+	m, err := loadManifest(ctx, s)
+	if err == nil {
+		ci.version = m.Version
+		ci.headers = m.Headers
+		for _, h := range ci.headers {
+			ci.adjustMinMax(h.Min)
+			ci.adjustMinMax(h.Max)
+		}
+		return ci, nil
+	}
+	if !errors.Is(err, storage.ErrDoesNotExist) {
+		logger.Error("NewChunkIndex: can not load manifest, walking headers", err)
+	}
+
 	// If start.idx doesn't exist, then we never started
-	startBin, err := s.Read(context.Background(), "start.idx")
+	startBin, err := s.Read(ctx, "start.idx")
 	if errors.Is(err, storage.ErrDoesNotExist) {
 		return ci, nil
 	}
 	if err != nil {
 		return ci, errors.Wrap(err, "NewChunkIndex: can not read start.idx")
 	}
-	if startBin != nil || len(startBin) > 0 {
-		startTimeKey := string(startBin)
-
-		t, err := time.Parse(layout, startTimeKey)
-		if err != nil {
-			return ci, errors.Wrap(err, "NewChunkIndex: can not parse start.idx")
-		}
-		t = t.UTC()
-
-		ci.minTime = t
-	} else {
+	// start.idx holds the id of the first chunk
+	if len(startBin) == 0 {
 		return ci, errors.New("NewChunkIndex: invalid start.idx")
 	}
+	t, err := ChunkId(startBin).Time()
+	if err != nil {
+		return ci, errors.Wrap(err, "NewChunkIndex: can not parse start.idx")
+	}
+	ci.minTime = t
 
 	// Load all headers
-	currChunkId := NewChunkId(ci.minTime)
+	currChunkId := ChunkId(startBin)
 	for currChunkId != "" {
-		h, err := LoadHeader(context.Background(), s, currChunkId)
+		h, err := LoadHeader(ctx, s, currChunkId)
 		if err != nil {
 			return ci, errors.Wrap(err, "NewChunkIndex: can not load header")
 		}
@@ -79,25 +117,78 @@ func NewChunkIndex(s storage.System, maxChunkAge time.Duration, logger telemetry
 		ci.adjustMinMax(h.Max)
 	}
 
+	// Next time we start we won't have to walk the headers
+	err = ci.saveManifest(ctx)
+	if err != nil {
+		return ci, errors.Wrap(err, "NewChunkIndex: can not save manifest")
+	}
+
 	return ci, nil
 }
 
+func loadManifest(ctx context.Context, s storage.System) (manifest, error) {
+	var m manifest
+	b, err := s.Read(ctx, manifestKey)
+	if err != nil {
+		return m, err
+	}
+	err = misc.DecodeFromBytes(b, &m)
+	if err != nil {
+		return m, errors.Wrap(err, "can not decode manifest")
+	}
+	return m, nil
+}
+
+// saveManifest writes the current headers as the next version of the manifest, the
+// caller must hold the lock or own the index
+func (ci *index) saveManifest(ctx context.Context) error {
+	m := manifest{Version: ci.version + 1, Headers: ci.headers}
+	b, err := misc.EncodeToBytes(m)
+	if err != nil {
+		return errors.Wrap(err, "can not encode manifest")
+	}
+	err = ci.storage.Write(ctx, manifestKey, b)
+	if err != nil {
+		return errors.Wrap(err, "can not write manifest")
+	}
+	ci.version = m.Version
+	return nil
+}
+
 func (ci *index) GetHeaders() []Header {
-	return ci.headers
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return append([]Header{}, ci.headers...)
+}
+
+func (ci *index) UpdateIndex(ctx context.Context, header Header) error {
+	err := ci.addHeader(ctx, header)
+	if err != nil {
+		return err
+	}
+
+	// Cleanup old headers & chunks, the lock is only held while headers are swapped so
+	// reads and writes aren't held up by chunks being rewritten
+	_, err = ci.ApplyRetention(ctx, ci.retention, false)
+	if err != nil {
+		ci.logger.Error("UpdateIndex: can not apply retention", err)
+	}
+	return nil
 }
 
-func (ci *index) UpdateIndex(header Header) error {
+// addHeader adds header to the index and links it to its neighbours
+func (ci *index) addHeader(ctx context.Context, header Header) error {
 	ci.lock.Lock()
 	defer ci.lock.Unlock()
 
 	if ci.minTime.IsZero() {
 		ci.adjustMinMax(header.Min)
 		ci.adjustMinMax(header.Max)
-		err := ci.storage.Write(context.Background(), "start.idx", []byte(ci.minTime.UTC().Format(layout)))
+		err := ci.storage.Write(ctx, "start.idx", []byte(header.Id))
 		if err != nil {
 			return errors.Wrap(err, "can not write start.idx")
 		}
-		defer header.Save(context.Background(), ci.storage)
+		defer header.Save(ctx, ci.storage)
 	}
 
 	ci.headers = append(ci.headers, header)
@@ -107,33 +198,6 @@ func (ci *index) UpdateIndex(header Header) error {
 		return ci.headers[i].Min.Before(ci.headers[j].Min)
 	})
 
-	// Cleanup old headers & chunks
-	if ci.maxChunkAge != time.Duration(0) {
-		for _, header := range ci.headers {
-			ci.adjustMinMax(header.Min)
-			ci.adjustMinMax(header.Max)
-		}
-		minValidTime := ci.maxTime.Add(-ci.maxChunkAge)
-		startIdx := 0
-		for idx := range ci.headers {
-			if ci.headers[idx].Max.Before(minValidTime) {
-				ci.headers[idx].RemoveFromStorage(context.Background(), ci.storage)
-				startIdx = idx + 1
-
-				// Adjust start index
-				err := ci.storage.Write(context.Background(), "start.idx", []byte(ci.headers[startIdx].Min.UTC().Format(layout)))
-				if err != nil {
-					return errors.Wrap(err, "can not write start.idx")
-				}
-
-				break
-			}
-		}
-		if startIdx != 0 {
-			ci.headers = ci.headers[startIdx+1:]
-		}
-	}
-
 	// Reset and recalculate
 	ci.minTime = time.Time{}
 	ci.maxTime = time.Time{}
@@ -158,23 +222,34 @@ func (ci *index) UpdateIndex(header Header) error {
 		}
 	}
 	for idx := range modified {
-		err := ci.headers[idx].Save(context.Background(), ci.storage)
+		err := ci.headers[idx].Save(ctx, ci.storage)
 		if err != nil {
 			return errors.Wrap(err, "can not save header")
 		}
 	}
 
-	return nil
+	return ci.saveManifest(ctx)
 }
 
 func (ci *index) GetMinTime() time.Time {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
 	return ci.minTime
 }
 
 func (ci *index) GetMaxTime() time.Time {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
 	return ci.maxTime
 }
 
+// covers reports whether any chunk holds state at timestamp
+func (ci *index) covers(timestamp time.Time) bool {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return !ci.minTime.IsZero() && !timestamp.Before(ci.minTime)
+}
+
 func (ci *index) adjustMinMax(a time.Time) {
 	if ci.minTime.IsZero() {
 		ci.minTime = a
@@ -191,16 +266,16 @@ func (ci *index) adjustMinMax(a time.Time) {
 }
 
 func (ci *index) findHeaderResponsibleFor(timestamp time.Time) (Header, error) {
-	ci.lock.Lock()
-	defer ci.lock.Unlock()
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
 
 	n := len(ci.headers)
 	if n == 0 {
 		return Header{}, nil
 	}
 
-	// Handle the case where the timestamp is after the last header's Min
-	if timestamp.After(ci.headers[n-1].Min) {
+	// Handle the case where the timestamp is at or after the last header's Min
+	if !timestamp.Before(ci.headers[n-1].Min) {
 		return ci.headers[n-1], nil
 	}
 
@@ -239,11 +314,12 @@ func (ci *index) findHeaderResponsibleFor(timestamp time.Time) (Header, error) {
 	return Header{}, errors.New("no header found")
 }
 
-func (ci *index) GetStateAt(timestamp time.Time) (map[string][]byte, error) {
-	if ci.minTime.IsZero() {
-		return map[string][]byte{}, nil
-	}
-	if timestamp.Before(ci.minTime) {
+func (ci *index) GetStateAt(ctx context.Context, timestamp time.Time) (map[string][]byte, error) {
+	return ci.GetRangeStateAt(ctx, timestamp, misc.KeyRange{})
+}
+
+func (ci *index) GetRangeStateAt(ctx context.Context, timestamp time.Time, r misc.KeyRange) (map[string][]byte, error) {
+	if !ci.covers(timestamp) {
 		return map[string][]byte{}, nil
 	}
 
@@ -253,10 +329,231 @@ func (ci *index) GetStateAt(timestamp time.Time) (map[string][]byte, error) {
 		return nil, errors.Wrap(err, "can not find header")
 	}
 
-	chunk, err := header.LoadChunk(context.Background(), ci.storage)
+	chain, err := ci.chain(ctx, header, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	state := map[string][]byte{}
+	for _, link := range chain {
+		own, err := link.chunk.GetRangeStateAt(link.timestamp, r)
+		if err != nil {
+			return nil, err
+		}
+		if link.chunk.Data.Seeded {
+			state = own
+			continue
+		}
+		for key := range link.chunk.touched(link.timestamp, r) {
+			if value, ok := own[key]; ok {
+				state[key] = value
+			} else {
+				delete(state, key)
+			}
+		}
+	}
+	return state, nil
+}
+
+// GetKeyFrameAt returns the state at timestamp with when each key was last written
+func (ci *index) GetKeyFrameAt(ctx context.Context, timestamp time.Time) (KeyFrame, error) {
+	if !ci.covers(timestamp) {
+		return KeyFrame{}, nil
+	}
+
+	header, err := ci.findHeaderResponsibleFor(timestamp)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not find header")
+	}
+
+	chain, err := ci.chain(ctx, header, timestamp)
 	if err != nil {
-		return nil, errors.Wrap(err, "can not load chunk")
+		return nil, err
 	}
+	state := map[string]KVPair{}
+	for _, link := range chain {
+		own, err := link.chunk.GetKeyFrameAt(link.timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if link.chunk.Data.Seeded {
+			state = map[string]KVPair{}
+		} else {
+			for key := range link.chunk.touched(link.timestamp, misc.KeyRange{}) {
+				delete(state, key)
+			}
+		}
+		for _, kv := range own {
+			state[kv.Key] = kv
+		}
+	}
+
+	keyFrame := make(KeyFrame, 0, len(state))
+	for _, kv := range misc.Range(state) {
+		keyFrame = append(keyFrame, kv)
+	}
+	return keyFrame, nil
+}
+
+// A link is a chunk and the time its state is wanted at
+type link struct {
+	chunk     Chunk
+	timestamp time.Time
+}
+
+// chain returns the chunk for header and, if it isn't seeded, the chunks before it back
+// to the first one that is, oldest first.  Chunks written before keyframes were seeded
+// only hold the keys they changed.
+func (ci *index) chain(ctx context.Context, header Header, timestamp time.Time) ([]link, error) {
+	chain := []link{}
+	for {
+		chunk, err := ci.loadChunk(ctx, header)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not load chunk")
+		}
+		chain = append([]link{{chunk: chunk, timestamp: timestamp}}, chain...)
+		if chunk.Data.Seeded {
+			return chain, nil
+		}
+		prev, ok := ci.previous(header)
+		if !ok {
+			return chain, nil
+		}
+		header, timestamp = prev, prev.Max
+	}
+}
+
+// previous returns the header before h in the index
+func (ci *index) previous(h Header) (Header, bool) {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+
+	idx := ci.position(h.Id)
+	if idx <= 0 {
+		return Header{}, false
+	}
+	return ci.headers[idx-1], true
+}
+
+// GetValueAt returns the value key had at timestamp, or nil if it wasn't set
+func (ci *index) GetValueAt(ctx context.Context, timestamp time.Time, key string) ([]byte, error) {
+	if !ci.covers(timestamp) {
+		return nil, nil
+	}
+
+	header, err := ci.findHeaderResponsibleFor(timestamp)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not find header")
+	}
+
+	// A chunk that isn't seeded only knows the keys it changed, the rest are found in the
+	// chunks before it
+	for {
+		chunk, err := ci.loadChunk(ctx, header)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not load chunk")
+		}
+		value, _, err := chunk.GetValueAt(timestamp, key)
+		if err != nil || chunk.Data.Seeded || chunk.touched(timestamp, misc.SingleKey(key))[key] {
+			return value, err
+		}
+		prev, ok := ci.previous(header)
+		if !ok {
+			return nil, nil
+		}
+		header, timestamp = prev, prev.Max
+	}
+}
+
+// LastWrite returns when key was last written at or before timestamp, or a zero time if
+// it never was.  Chunks are searched newest first and only until the write is found.
+func (ci *index) LastWrite(ctx context.Context, key string, timestamp time.Time) (time.Time, error) {
+	headers := ci.getHeadersBetween(time.Time{}, timestamp)
+	for idx := len(headers) - 1; idx >= 0; idx-- {
+		chunk, err := ci.loadChunk(ctx, headers[idx])
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "can not load chunk")
+		}
+		if version, ok := chunk.LastWrite(key, timestamp); ok {
+			return version, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// Returns the headers whose time range overlaps [from, to]
+func (ci *index) getHeadersBetween(from time.Time, to time.Time) []Header {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+
+	ret := []Header{}
+	for _, h := range ci.headers {
+		if h.Max.Before(from) || h.Min.After(to) {
+			continue
+		}
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+// GetRangeHistory returns every write to the keys in r between from and to (inclusive)
+// across all of the chunks covering that range, in timestamp order.
+func (ci *index) GetRangeHistory(ctx context.Context, r misc.KeyRange, from time.Time, to time.Time) ([]Event, error) {
+	ret := []Event{}
+
+	last := map[string][]byte{}
+	for _, header := range ci.getHeadersBetween(from, to) {
+		chunk, err := ci.loadChunk(ctx, header)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not load chunk")
+		}
+		base, events, err := chunk.GetRangeHistory(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not get range history")
+		}
+
+		// A keyframe value is only a new version if it differs from where the previous chunk left
+		// off, a seeded keyframe only holds what was carried over
+		if !chunk.Data.Seeded && inRange(chunk.Data.Timestamp, from, to) {
+			for key, data := range misc.Range(base) {
+				if !bytes.Equal(data, last[key]) {
+					ret = append(ret, Event{Timestamp: chunk.Data.Timestamp, Key: key, Data: data})
+				}
+			}
+		}
+		for key, data := range base {
+			last[key] = data
+		}
+
+		for _, e := range events {
+			if inRange(e.Timestamp, from, to) {
+				ret = append(ret, e)
+			}
+			last[e.Key] = e.Data
+		}
+	}
+
+	return ret, nil
+}
+
+// GetChanges returns every key written in (from, to] with the value it had before
+// and after that window.
+func (ci *index) GetChanges(ctx context.Context, from time.Time, to time.Time) (map[string]KeyChange, error) {
+	changes := map[string]KeyChange{}
+
+	for _, header := range ci.getHeadersBetween(from, to) {
+		chunk, err := ci.loadChunk(ctx, header)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not load chunk")
+		}
+		err = chunk.GetChanges(from, to, changes)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not get changes")
+		}
+	}
+
+	return changes, nil
+}
 
-	return chunk.GetStateAt(timestamp)
+func inRange(timestamp time.Time, from time.Time, to time.Time) bool {
+	return !timestamp.Before(from) && !timestamp.After(to)
 }
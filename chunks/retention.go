@@ -0,0 +1,349 @@
+package chunks
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/hoyle1974/temporal/misc"
+	"github.com/hoyle1974/temporal/storage"
+)
+
+// RetentionPolicy decides which chunks are kept, a zero field doesn't limit anything.
+// Whole chunks are only ever removed from the oldest end of the index and the newest
+// chunk is always kept, it holds the current state.
+type RetentionPolicy struct {
+	MaxAge    time.Duration // Remove chunks that ended this long before the newest data
+	Before    time.Time     // Remove chunks that ended before this time
+	MaxBytes  int64         // Remove the oldest chunks until the rest fit in this many bytes
+	MaxChunks int           // Remove the oldest chunks until no more than this many remain
+	Prefixes  []PrefixRetention
+}
+
+// PrefixRetention drops the history of keys starting with Prefix from chunks that ended
+// more than MaxAge before the newest data
+type PrefixRetention struct {
+	Prefix string
+	MaxAge time.Duration
+}
+
+func (p RetentionPolicy) IsZero() bool {
+	return p.MaxAge == 0 && p.Before.IsZero() && p.MaxBytes == 0 && p.MaxChunks == 0 && len(p.Prefixes) == 0
+}
+
+// RetentionReport describes what a retention pass removed, or would remove on a dry run
+type RetentionReport struct {
+	Removed   []ChunkId // Chunks removed entirely
+	Rewritten []ChunkId // Chunks that had keys dropped by a prefix rule
+	Bytes     int64     // Bytes freed
+}
+
+// ApplyRetention applies policy to the index.  Chunks are copied to the archive, if the
+// index has one, before they are removed or rewritten.  With dryRun nothing is changed
+// and the report says what would have been.  Like Compact the changes are planned and
+// built without holding the lock, which is only taken to swap the headers.
+func (ci *index) ApplyRetention(ctx context.Context, policy RetentionPolicy, dryRun bool) (RetentionReport, error) {
+	plan, err := ci.planRetention(ctx, policy)
+	if err != nil || dryRun {
+		return plan.report, err
+	}
+
+	// Archive everything first so a failure leaves the index as it was
+	if ci.archive != nil {
+		for _, h := range plan.archive() {
+			err := archiveChunk(ctx, ci.storage, ci.archive, h)
+			if err != nil {
+				return plan.report, errors.Wrap(err, "can not archive chunk")
+			}
+		}
+	}
+
+	for idx, chunk := range plan.rewrites {
+		h := plan.headers[idx]
+		chunk.Header.Prev, chunk.Header.Next = h.Prev, h.Next
+		err := chunk.Save(ctx, ci.storage)
+		if err != nil {
+			return plan.report, errors.Wrap(err, "can not save rewritten chunk")
+		}
+
+		err = ci.replaceHeaders(ctx, []Header{h}, chunk.Header)
+		if errors.Is(err, errIndexChanged) {
+			// The next pass will look at it again
+			chunk.Header.RemoveFromStorage(context.WithoutCancel(ctx), ci.storage)
+			continue
+		}
+		if err != nil {
+			return plan.report, errors.Wrap(err, "can not replace header")
+		}
+		ci.removeChunks(ctx, []Header{h})
+	}
+
+	if plan.remove > 0 {
+		removed := plan.headers[:plan.remove]
+		err := ci.dropOldest(ctx, removed)
+		if errors.Is(err, errIndexChanged) {
+			return plan.report, nil
+		}
+		if err != nil {
+			return plan.report, err
+		}
+		ci.removeChunks(ctx, removed)
+		ci.releaseEvents(ctx)
+	}
+	return plan.report, nil
+}
+
+// A retentionPlan is what a retention pass changes, worked out from a copy of the headers
+type retentionPlan struct {
+	headers  []Header
+	remove   int            // How many of the oldest chunks are removed
+	rewrites map[int]*Chunk // Chunks with prefixes dropped by the position of the one they replace
+	report   RetentionReport
+}
+
+// archive returns the headers of every chunk the plan removes or rewrites
+func (p retentionPlan) archive() []Header {
+	headers := append([]Header{}, p.headers[:p.remove]...)
+	for idx := range p.rewrites {
+		headers = append(headers, p.headers[idx])
+	}
+	return headers
+}
+
+// planRetention works out what policy changes and builds the rewritten chunks, nothing
+// is saved
+func (ci *index) planRetention(ctx context.Context, policy RetentionPolicy) (retentionPlan, error) {
+	ci.lock.RLock()
+	headers := append([]Header{}, ci.headers...)
+	maxTime := ci.maxTime
+	ci.lock.RUnlock()
+
+	plan := retentionPlan{
+		headers:  headers,
+		rewrites: map[int]*Chunk{},
+		report:   RetentionReport{Removed: []ChunkId{}, Rewritten: []ChunkId{}},
+	}
+	if policy.IsZero() || len(headers) < 2 {
+		return plan, nil
+	}
+
+	remove, err := ci.chunksToRemove(ctx, policy, headers, maxTime)
+	if err != nil {
+		return plan, err
+	}
+	plan.remove = remove
+	for _, h := range headers[:remove] {
+		size, err := ci.chunkSize(ctx, h)
+		if err != nil {
+			return plan, err
+		}
+		plan.report.Removed = append(plan.report.Removed, h.Id)
+		plan.report.Bytes += size
+	}
+
+	// Rewrite what is left, apart from the newest chunk, without the expired prefixes
+	for idx := remove; idx < len(headers)-1; idx++ {
+		h := headers[idx]
+		prefixes := []string{}
+		for _, p := range policy.Prefixes {
+			if maxTime.Sub(h.Max) > p.MaxAge && !dropped(h, p.Prefix) {
+				prefixes = append(prefixes, p.Prefix)
+			}
+		}
+		if len(prefixes) == 0 {
+			continue
+		}
+
+		chunk, err := h.LoadChunk(ctx, ci.storage)
+		if err != nil {
+			return plan, errors.Wrap(err, "can not load chunk")
+		}
+		rewritten, err := dropPrefixes(chunk, prefixes, ci.checkpoints)
+		if err != nil {
+			return plan, errors.Wrap(err, "can not drop prefixes")
+		}
+		oldSize, err := ci.chunkSize(ctx, h)
+		if err != nil {
+			return plan, err
+		}
+		newSize, err := rewritten.EstimateSize()
+		if err != nil {
+			return plan, err
+		}
+		plan.rewrites[idx] = rewritten
+		plan.report.Rewritten = append(plan.report.Rewritten, h.Id)
+		plan.report.Bytes += max(oldSize-newSize, 0)
+	}
+
+	return plan, nil
+}
+
+// dropOldest removes removed from the start of the index, it returns errIndexChanged if
+// they aren't the oldest headers any more
+func (ci *index) dropOldest(ctx context.Context, removed []Header) error {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	if len(ci.headers) <= len(removed) {
+		return errIndexChanged
+	}
+	for idx, h := range removed {
+		if ci.headers[idx].Id != h.Id {
+			return errIndexChanged
+		}
+	}
+
+	ci.headers = append([]Header{}, ci.headers[len(removed):]...)
+	ci.headers[0].Prev = ""
+	err := ci.headers[0].Save(ctx, ci.storage)
+	if err != nil {
+		return errors.Wrap(err, "can not save header")
+	}
+	err = ci.storage.Write(ctx, "start.idx", []byte(ci.headers[0].Id))
+	if err != nil {
+		return errors.Wrap(err, "can not write start.idx")
+	}
+
+	ci.minTime = time.Time{}
+	ci.maxTime = time.Time{}
+	for _, h := range ci.headers {
+		ci.adjustMinMax(h.Min)
+		ci.adjustMinMax(h.Max)
+	}
+	return ci.saveManifest(ctx)
+}
+
+// removeChunks deletes chunks that the manifest no longer lists
+func (ci *index) removeChunks(ctx context.Context, old []Header) {
+	for _, h := range old {
+		ci.cache.Remove(h.Id)
+		err := h.RemoveFromStorage(context.WithoutCancel(ctx), ci.storage)
+		if err != nil {
+			ci.logger.Error(fmt.Sprintf("can not remove chunk %s", h.Id), err)
+		}
+	}
+}
+
+// releaseEvents deletes the retained event logs older than every chunk, nothing will be
+// rebuilt from them
+func (ci *index) releaseEvents(ctx context.Context) {
+	if ci.corruption.Mode != RebuildCorrupt || ci.corruption.Release == nil {
+		return
+	}
+	err := ci.corruption.Release(context.WithoutCancel(ctx), ci.GetMinTime())
+	if err != nil {
+		ci.logger.Error("can not release retained events", err)
+	}
+}
+
+// chunksToRemove returns how many of the oldest of headers policy removes
+func (ci *index) chunksToRemove(ctx context.Context, policy RetentionPolicy, headers []Header, maxTime time.Time) (int, error) {
+	n := len(headers)
+	remove := 0
+
+	for idx, h := range headers {
+		expired := (policy.MaxAge > 0 && maxTime.Sub(h.Max) > policy.MaxAge) ||
+			(!policy.Before.IsZero() && h.Max.Before(policy.Before))
+		if !expired {
+			break
+		}
+		remove = idx + 1
+	}
+
+	if policy.MaxChunks > 0 && n-policy.MaxChunks > remove {
+		remove = n - policy.MaxChunks
+	}
+
+	if policy.MaxBytes > 0 {
+		var total int64
+		sizes := make([]int64, n)
+		for idx, h := range headers {
+			size, err := ci.chunkSize(ctx, h)
+			if err != nil {
+				return 0, err
+			}
+			sizes[idx] = size
+			total += size
+		}
+		for idx := 0; total > policy.MaxBytes && idx < n; idx++ {
+			total -= sizes[idx]
+			remove = max(remove, idx+1)
+		}
+	}
+
+	// The newest chunk holds the current state
+	return min(remove, n-1), nil
+}
+
+func dropped(h Header, prefix string) bool {
+	for _, p := range h.Dropped {
+		if strings.HasPrefix(prefix, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropPrefixes builds a copy of chunk without any keys starting with prefixes
+func dropPrefixes(chunk Chunk, prefixes []string, checkpoints Checkpoints) (*Chunk, error) {
+	keep := func(key string) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(key, p) {
+				return false
+			}
+		}
+		return true
+	}
+
+	_, events, err := chunk.GetRangeHistory(misc.KeyRange{})
+	if err != nil {
+		return nil, errors.Wrap(err, "can not read chunk")
+	}
+	keyFrame := KeyFrame{}
+	for _, kv := range chunk.KeyFrame() {
+		if keep(kv.Key) {
+			keyFrame = append(keyFrame, kv)
+		}
+	}
+	kept := make([]Event, 0, len(events))
+	for _, e := range events {
+		if keep(e.Key) {
+			kept = append(kept, e)
+		}
+	}
+
+	header := chunk.Header
+	header.Id = newCompactedChunkId(chunk.Data.Timestamp, time.Now())
+	header.LastUpdate = time.Now().UTC()
+	header.Dropped = append(append([]string{}, header.Dropped...), prefixes...)
+
+	rewritten := &Chunk{
+		Header: header,
+		Data: ChunkData{
+			Id:        header.Id,
+			Timestamp: chunk.Data.Timestamp,
+			Seeded:    chunk.Data.Seeded,
+		},
+	}
+	rewritten.Finish(keyFrame, kept, checkpoints)
+
+	return rewritten, nil
+}
+
+// archiveChunk copies a chunk and its header to archive
+func archiveChunk(ctx context.Context, s storage.System, archive storage.System, h Header) error {
+	for _, key := range []string{h.Id.ChunkKey(), h.Id.HeaderKey()} {
+		b, err := s.Read(ctx, key)
+		if err != nil {
+			return errors.Wrapf(err, "can not read %s", key)
+		}
+		err = archive.Write(ctx, key, b)
+		if err != nil {
+			return errors.Wrapf(err, "can not write %s", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package temporal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ConditionalWrite only writes when the key is still in the state the caller expects
+type ConditionalWrite interface {
+	// SetIf writes data if key currently holds expected, a nil expected means key must not exist
+	SetIf(ctx context.Context, timestamp time.Time, key string, expected []byte, data []byte) error
+	// DelIf removes key if it currently holds expected
+	DelIf(ctx context.Context, timestamp time.Time, key string, expected []byte) error
+	// SetIfVersion writes data if key was last written at version
+	SetIfVersion(ctx context.Context, timestamp time.Time, key string, version time.Time, data []byte) error
+	// DelIfVersion removes key if it was last written at version
+	DelIfVersion(ctx context.Context, timestamp time.Time, key string, version time.Time) error
+	// GetVersion returns the current value of key and when it was last written.  A key that
+	// was never written has a zero Timestamp.
+	GetVersion(ctx context.Context, key string) (Version, error)
+}
+
+// ErrConflict matches every ConflictError
+var ErrConflict = errors.New("conflict")
+
+// ConflictError is returned when a conditional write's precondition does not hold.  It
+// carries the current state of the key so the caller can retry.
+type ConflictError struct {
+	Key     string
+	Current Version
+}
+
+func (e *ConflictError) Error() string {
+	if e.Current.Timestamp.IsZero() {
+		return fmt.Sprintf("conflict on key %q: never written", e.Key)
+	}
+	return fmt.Sprintf("conflict on key %q: last written at %v", e.Key, e.Current.Timestamp)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// SetIf implements ReadWriteMap.
+func (t *temporalMap) SetIf(ctx context.Context, timestamp time.Time, key string, expected []byte, data []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+
+	if err := t.checkValue(ctx, timestamp, key, expected); err != nil {
+		return err
+	}
+	return t.set(ctx, timestamp, key, data, time.Time{})
+}
+
+// DelIf implements ReadWriteMap.
+func (t *temporalMap) DelIf(ctx context.Context, timestamp time.Time, key string, expected []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+
+	if err := t.checkValue(ctx, timestamp, key, expected); err != nil {
+		return err
+	}
+	return t.del(ctx, timestamp, key)
+}
+
+// SetIfVersion implements ReadWriteMap.
+func (t *temporalMap) SetIfVersion(ctx context.Context, timestamp time.Time, key string, version time.Time, data []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+
+	if err := t.checkVersion(ctx, timestamp, key, version); err != nil {
+		return err
+	}
+	return t.set(ctx, timestamp, key, data, time.Time{})
+}
+
+// DelIfVersion implements ReadWriteMap.
+func (t *temporalMap) DelIfVersion(ctx context.Context, timestamp time.Time, key string, version time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+
+	if err := t.checkVersion(ctx, timestamp, key, version); err != nil {
+		return err
+	}
+	return t.del(ctx, timestamp, key)
+}
+
+// GetVersion implements ReadWriteMap.
+func (t *temporalMap) GetVersion(ctx context.Context, key string) (Version, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return Version{}, ErrMapClosed
+	}
+
+	return t.currentVersion(ctx, key)
+}
+
+// checkValue verifies the precondition for a write at timestamp, the caller must hold the lock
+func (t *temporalMap) checkValue(ctx context.Context, timestamp time.Time, key string, expected []byte) error {
+	// Keys that expire by the time of the write must not satisfy the precondition
+	if err := t.advance(ctx, timestamp, "conditional write"); err != nil {
+		return err
+	}
+
+	data, ok := t.data[key]
+	if ok == (expected != nil) && bytes.Equal(data, expected) {
+		return nil
+	}
+
+	current, err := t.currentVersion(ctx, key)
+	if err != nil {
+		return err
+	}
+	return &ConflictError{Key: key, Current: current}
+}
+
+func (t *temporalMap) checkVersion(ctx context.Context, timestamp time.Time, key string, version time.Time) error {
+	if err := t.advance(ctx, timestamp, "conditional write"); err != nil {
+		return err
+	}
+
+	current, err := t.currentVersion(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !current.Timestamp.Equal(version) {
+		return &ConflictError{Key: key, Current: current}
+	}
+	return nil
+}
+
+// currentVersion returns the current state of key, the caller must hold the lock
+func (t *temporalMap) currentVersion(ctx context.Context, key string) (Version, error) {
+	data, ok := t.data[key]
+	timestamp, err := t.lastWrite(ctx, key)
+	if err != nil {
+		return Version{}, err
+	}
+	return Version{Timestamp: timestamp, Data: data, Delete: !ok && !timestamp.IsZero()}, nil
+}
+
+// lastWrite returns when key was last written.  Keys not written since the map was opened
+// are looked up in the chunks once and remembered.
+func (t *temporalMap) lastWrite(ctx context.Context, key string) (time.Time, error) {
+	if timestamp, ok := t.versions[key]; ok {
+		return timestamp, nil
+	}
+
+	timestamp, err := t.index.LastWrite(ctx, key, t.current)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "can not find last write")
+	}
+	t.versions[key] = timestamp
+	return timestamp, nil
+}
@@ -0,0 +1,119 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/hoyle1974/temporal/storage"
+	"github.com/hoyle1974/temporal/telemetry"
+)
+
+// DurabilityMode decides when the event log is synced to storage
+type DurabilityMode int
+
+const (
+	SyncNone       DurabilityMode = iota // Leave it to the storage system, a crash can lose acknowledged writes
+	SyncEveryWrite                       // Sync before every write is acknowledged
+	SyncGroup                            // Acknowledge writes and sync once Bytes have been written or Interval after the first unsynced write
+)
+
+// Durability is when the event log is synced, Interval and Bytes are only used by SyncGroup
+type Durability struct {
+	Mode     DurabilityMode
+	Interval time.Duration
+	Bytes    int64
+}
+
+// Supported returns an error if s can't sync its streams as the mode requires
+func (d Durability) Supported(s storage.System) error {
+	if d.Mode != SyncNone && !storage.CanSync(s) {
+		return errors.Wrap(storage.ErrSyncUnsupported, "storage can only make event logs durable by closing them")
+	}
+	return nil
+}
+
+const defaultGroupInterval = 10 * time.Millisecond
+
+// groupCommit syncs the event log according to a Durability
+type groupCommit struct {
+	durability Durability
+	logger     telemetry.Logger
+
+	lock    sync.Mutex
+	writer  storage.StreamWriter // The stream with unsynced writes
+	pending int64
+	timer   *time.Timer
+}
+
+func newGroupCommit(durability Durability, logger telemetry.Logger) *groupCommit {
+	if durability.Mode == SyncGroup && durability.Interval <= 0 && durability.Bytes <= 0 {
+		durability.Interval = defaultGroupInterval
+	}
+	return &groupCommit{durability: durability, logger: logger}
+}
+
+// write writes record to w and returns once it is as durable as the mode requires.  With
+// SyncGroup the write holds the lock the timer syncs under, so a sync never runs while
+// the stream is being written to.
+func (g *groupCommit) write(w storage.StreamWriter, record []byte) (int, error) {
+	if g.durability.Mode == SyncGroup {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+	}
+	n, err := w.Write(record)
+	if err != nil {
+		return n, errors.Wrap(err, "can not write event")
+	}
+	if n != len(record) {
+		return n, errors.New("could not write all data to the file")
+	}
+
+	switch g.durability.Mode {
+	case SyncNone:
+		return n, nil
+	case SyncEveryWrite:
+		return n, errors.Wrap(storage.Sync(w), "can not sync event log")
+	}
+
+	g.writer = w
+	g.pending += int64(n)
+	if g.durability.Bytes > 0 && g.pending >= g.durability.Bytes {
+		return n, g.sync()
+	}
+	if g.timer == nil && g.durability.Interval > 0 {
+		g.timer = time.AfterFunc(g.durability.Interval, func() {
+			g.lock.Lock()
+			defer g.lock.Unlock()
+			err := g.sync()
+			if err != nil {
+				g.logger.Error("can not sync event log", err)
+			}
+		})
+	}
+	return n, nil
+}
+
+// closing syncs anything pending before the stream is closed
+func (g *groupCommit) closing() error {
+	if g.durability.Mode != SyncGroup {
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.sync()
+}
+
+// sync syncs the pending writes, the caller must hold the lock
+func (g *groupCommit) sync() error {
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	if g.pending == 0 {
+		return nil
+	}
+	g.pending = 0
+	return errors.Wrap(storage.Sync(g.writer), "can not sync event log")
+}
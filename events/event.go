@@ -7,6 +7,7 @@ type Event struct {
 	Key       string
 	Data      []byte
 	Delete    bool
+	Expires   time.Time // When set the key is removed at this time unless written again
 }
 
 func (e Event) Apply(ret map[string][]byte) {
@@ -0,0 +1,99 @@
+package events
+
+import "time"
+
+// LogState describes the open event log to a FlushPolicy
+type LogState struct {
+	Started  time.Time // When the first event was written, by the wall clock
+	First    time.Time // Timestamp of the first event
+	Last     time.Time // Timestamp of the newest event
+	Events   int
+	Bytes    int64
+	Full     bool // The estimator thinks this log, and any left over before it, fill a chunk
+	Chunking bool // Older logs are still being chunked
+}
+
+// FlushDecision is what a FlushPolicy wants done with the open event log
+type FlushDecision int
+
+const (
+	KeepWriting FlushDecision = iota // Keep writing to the open event log
+	TryFlush                         // Chunk the log if it makes a chunk of the target size, otherwise keep it for the next one
+	FlushNow                         // Chunk the log whatever its size
+)
+
+// FlushPolicy decides when the open event log is closed and chunked.  It is asked before
+// an event with timestamp next is written to a log that has at least one event in it.
+type FlushPolicy interface {
+	ShouldFlush(log LogState, next time.Time) FlushDecision
+}
+
+// DefaultFlushPolicy chunks once the target size is reached, checking again every 10
+// seconds in case the estimate was wrong
+var DefaultFlushPolicy FlushPolicy = FlushOnSize{Retry: 10 * time.Second}
+
+// FlushOnSize tries to chunk once the log is estimated to fill a chunk, or once it has
+// been open for Retry if that isn't zero
+type FlushOnSize struct {
+	Retry time.Duration
+}
+
+func (p FlushOnSize) ShouldFlush(log LogState, next time.Time) FlushDecision {
+	// A log that is already being chunked may be what the estimate is counting
+	if (log.Full && !log.Chunking) || (p.Retry > 0 && time.Since(log.Started) > p.Retry) {
+		return TryFlush
+	}
+	return KeepWriting
+}
+
+// FlushOnAge chunks the log once its first event was written MaxAge ago
+type FlushOnAge struct {
+	MaxAge time.Duration
+}
+
+func (p FlushOnAge) ShouldFlush(log LogState, next time.Time) FlushDecision {
+	if time.Since(log.Started) >= p.MaxAge {
+		return FlushNow
+	}
+	return KeepWriting
+}
+
+// FlushOnCount chunks the log once it holds Events events
+type FlushOnCount struct {
+	Events int
+}
+
+func (p FlushOnCount) ShouldFlush(log LogState, next time.Time) FlushDecision {
+	if log.Events >= p.Events {
+		return FlushNow
+	}
+	return KeepWriting
+}
+
+// FlushOnBoundary chunks the log before the first event past a multiple of Every, so
+// with an Every of time.Hour each chunk holds at most one hour of events
+type FlushOnBoundary struct {
+	Every time.Duration
+}
+
+func (p FlushOnBoundary) ShouldFlush(log LogState, next time.Time) FlushDecision {
+	if p.Every > 0 && !next.Truncate(p.Every).Equal(log.First.Truncate(p.Every)) {
+		return FlushNow
+	}
+	return KeepWriting
+}
+
+// FlushAny makes the strongest decision of policies
+func FlushAny(policies ...FlushPolicy) FlushPolicy {
+	return flushAny(policies)
+}
+
+type flushAny []FlushPolicy
+
+func (p flushAny) ShouldFlush(log LogState, next time.Time) FlushDecision {
+	decision := KeepWriting
+	for _, policy := range p {
+		decision = max(decision, policy.ShouldFlush(log, next))
+	}
+	return decision
+}
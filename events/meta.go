@@ -7,7 +7,7 @@ import (
 )
 
 type Meta interface {
-	GetEventFiles() ([]string, error)
+	GetEventFiles(ctx context.Context) ([]string, error)
 }
 
 func NewMeta(storage storage.System) (Meta, error) {
@@ -18,6 +18,6 @@ type meta struct {
 	store storage.System
 }
 
-func (m *meta) GetEventFiles() ([]string, error) {
-	return m.store.GetKeysWithPrefix(context.Background(), "events/")
+func (m *meta) GetEventFiles(ctx context.Context) ([]string, error) {
+	return m.store.GetKeysWithPrefix(ctx, "events/")
 }
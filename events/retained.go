@@ -0,0 +1,145 @@
+package events
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/hoyle1974/temporal/chunks"
+	"github.com/hoyle1974/temporal/storage"
+)
+
+// Event logs that are retained are copied here before they are chunked, so a corrupt
+// chunk can be built again from the events that went into it.  Each is named for the
+// times of its first and last events so only the logs a chunk needs are read.
+const retainedPrefix = "retained/"
+
+func retainedKey(from time.Time, to time.Time) string {
+	return retainedPrefix + from.UTC().Format(layout) + "-" + to.UTC().Format(layout) + ".events"
+}
+
+// retainedRange returns the times a retained log covers, false for logs retained
+// before they were named for them
+func retainedRange(key string) (time.Time, time.Time, bool) {
+	name := strings.TrimSuffix(strings.TrimPrefix(key, retainedPrefix), ".events")
+	first, last, ok := strings.Cut(name, "-")
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	from, err := time.Parse(layout, first)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	to, err := time.Parse(layout, last)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+func retainEventLogs(ctx context.Context, s storage.System, logs map[string][]Event) error {
+	for key, events := range logs {
+		if len(events) == 0 {
+			continue
+		}
+		from, to := events[0].Timestamp, events[0].Timestamp
+		for _, e := range events {
+			from = minTime(from, e.Timestamp)
+			to = maxTime(to, e.Timestamp)
+		}
+
+		b, err := s.Read(ctx, key)
+		if err != nil {
+			return errors.Wrapf(err, "can not read %s", key)
+		}
+		err = s.Write(ctx, retainedKey(from, to), b)
+		if err != nil {
+			return errors.Wrapf(err, "can not write %s", retainedKey(from, to))
+		}
+	}
+	return nil
+}
+
+// RetainedEvents returns the events in the retained event logs between from and to
+// (inclusive), in timestamp order
+func RetainedEvents(ctx context.Context, s storage.System, from time.Time, to time.Time) ([]chunks.Event, error) {
+	keys, err := s.GetKeysWithPrefix(ctx, retainedPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not get retained event logs")
+	}
+
+	ret := []chunks.Event{}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".events") {
+			continue
+		}
+		if first, last, ok := retainedRange(key); ok && (last.Before(from) || first.After(to)) {
+			continue
+		}
+		events, err := GetEvents(ctx, s, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not get events")
+		}
+		for _, e := range events {
+			if e.Timestamp.Before(from) || e.Timestamp.After(to) {
+				continue
+			}
+			ret = append(ret, chunks.Event{Timestamp: e.Timestamp, Key: e.Key, Data: e.Data, Delete: e.Delete})
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Timestamp.Before(ret[j].Timestamp)
+	})
+	return ret, nil
+}
+
+// ReleaseRetainedEvents deletes the retained event logs that only hold events from
+// before, once no chunk is left that could be rebuilt from them
+func ReleaseRetainedEvents(ctx context.Context, s storage.System, before time.Time) error {
+	keys, err := s.GetKeysWithPrefix(ctx, retainedPrefix)
+	if err != nil {
+		return errors.Wrap(err, "can not get retained event logs")
+	}
+
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".events") {
+			continue
+		}
+		_, last, ok := retainedRange(key)
+		if !ok {
+			events, err := GetEvents(ctx, s, key)
+			if err != nil {
+				return errors.Wrap(err, "can not get events")
+			}
+			for _, e := range events {
+				last = maxTime(last, e.Timestamp)
+			}
+		}
+		if !last.Before(before) {
+			continue
+		}
+		err = s.Delete(ctx, key)
+		if err != nil {
+			return errors.Wrapf(err, "can not delete %s", key)
+		}
+	}
+	return nil
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -1,11 +1,13 @@
 package events
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/errors"
@@ -19,12 +21,37 @@ import (
 const layout = "20060102_150405.000000000"
 
 type Sink interface {
-	Append(event Event) (bool, error)
+	Append(ctx context.Context, event Event) error
+	AppendBatch(ctx context.Context, events []Event) error
+	Flush(ctx context.Context, timestamp time.Time) error
+	Close() error
 }
 
+var ErrSinkClosed = errors.New("sink closed")
+
 type Index interface {
-	GetStateAt(timestamp time.Time) (map[string][]byte, error)
-	UpdateIndex(header chunks.Header) error
+	GetMaxTime() time.Time
+	GetKeyFrameAt(ctx context.Context, timestamp time.Time) (chunks.KeyFrame, error)
+	UpdateIndex(ctx context.Context, header chunks.Header) error
+}
+
+// Options controls how event logs are written and turned into chunks
+type Options struct {
+	Checkpoints  chunks.Checkpoints // How the chunks built from the events store their diffs
+	RetainEvents bool               // Keep event logs once they are chunked
+	Recover      bool               // Drop a torn or corrupt tail from an event log instead of failing
+	Durability   Durability         // When writes to the event log are synced
+	QueueSize    int                // How many event logs may wait to be chunked before writes wait
+	FlushPolicy  FlushPolicy        // When the event log is chunked, DefaultFlushPolicy if nil
+}
+
+const defaultQueueSize = 4
+
+// A chunkJob is a set of closed event logs for the worker to turn into a chunk
+type chunkJob struct {
+	keys             []string
+	minimumChunkSize int64
+	done             chan error // Receives the result when someone is waiting for it
 }
 
 type Estimator interface {
@@ -34,53 +61,125 @@ type Estimator interface {
 }
 
 type sink struct {
-	key               string
-	store             storage.System
-	index             Index
-	totalBytesWritten int64
-	writer            storage.StreamWriter
-	chunkTargetSize   int64
-	maxChunkAge       time.Duration
-	estimator         Estimator
-	meta              Meta
-	logger            telemetry.Logger
-	metrics           telemetry.Metrics
-	lastFlush         time.Time
+	ctx             context.Context // Lifetime of the event streams, not of any one request
+	key             string
+	keyTime         time.Time // When key is named for, the next stream must be named for later
+	store           storage.System
+	index           Index
+	log             LogState // The open event log, Chunking isn't kept up to date
+	writer          storage.StreamWriter
+	chunkTargetSize int64
+	maxChunkAge     time.Duration
+	options         Options
+	commit          *groupCommit
+	estimator       Estimator
+	logger          telemetry.Logger
+	metrics         telemetry.Metrics
+	closed          bool
+
+	// Chunks are built by a worker so writes don't wait for them, unless the queue is full
+	queue    chan chunkJob
+	taken    chan struct{} // Signalled whenever the worker takes a job
+	busy     atomic.Int32  // Jobs queued or being worked on
+	unqueued []string      // Closed event logs that haven't been queued yet
+	worker   sync.WaitGroup
 }
 
+// A record's length prefix uses its top bit to mark a batch of events that are
+// written, read and chunked together.  The next bit marks a record whose length is
+// followed by a crc32 of its content, records written before checksums don't have it.
+const (
+	batchRecord   = uint32(1) << 31
+	checkedRecord = uint32(1) << 30
+	recordFlags   = batchRecord | checkedRecord
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrTornRecord is returned for an event log that ends in a partial or corrupt record
+var ErrTornRecord = errors.New("torn event record")
+
 // Append implements Sink.  It will append the event to the current chunk stream.
-// If the chunk becomes too big, it will flush the current chunk and start a new
-// one.
-func (s *sink) Append(event Event) (bool, error) {
+// When the flush policy says so, the stream is first handed to the worker to be
+// chunked and a new one is started.
+func (s *sink) Append(ctx context.Context, event Event) error {
 	b, err := misc.EncodeToBytes(event)
 	if err != nil {
-		return false, errors.Wrap(err, "can not encode event")
+		return errors.Wrap(err, "can not encode event")
+	}
+	return s.appendRecord(ctx, b, 0, 1, event.Timestamp, event.Timestamp)
+}
+
+// AppendBatch implements Sink.  All of the events are written as a single record so
+// they are either all seen or none of them are.
+func (s *sink) AppendBatch(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
 	}
-	value := uint32(len(b))
-	err = binary.Write(s.writer, binary.BigEndian, value)
+	b, err := misc.EncodeToBytes(events)
 	if err != nil {
-		return false, errors.Wrap(err, "can not write event length")
+		return errors.Wrap(err, "can not encode events")
 	}
-	bytesWritten, err := s.writer.Write(b)
+	return s.appendRecord(ctx, b, batchRecord, len(events), events[0].Timestamp, events[len(events)-1].Timestamp)
+}
+
+func (s *sink) appendRecord(ctx context.Context, b []byte, flags uint32, count int, first time.Time, last time.Time) error {
+	if s.closed {
+		return ErrSinkClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "can not append event")
+	}
+	if uint32(len(b))&recordFlags != 0 {
+		return errors.New("record is too large")
+	}
+
+	// Nothing is written while the worker is too far behind
+	err := s.waitForQueue(ctx)
 	if err != nil {
-		return false, errors.Wrap(err, "can not write event")
+		return err
 	}
-	if bytesWritten != len(b) {
-		return false, errors.New("could not write all data to the file")
+
+	if s.log.Events > 0 {
+		state := s.log
+		state.Full = s.estimator.ShouldTryFlush()
+		state.Chunking = s.busy.Load() > 0
+		minimumChunkSize := int64(-1)
+		switch s.options.FlushPolicy.ShouldFlush(state, first) {
+		case TryFlush:
+			minimumChunkSize = s.chunkTargetSize
+		case FlushNow:
+			minimumChunkSize = 0
+		}
+		if minimumChunkSize >= 0 {
+			// Chunk the log and start a new one for this event
+			err = s.rotate(ctx, s.log.Last, minimumChunkSize, nil)
+			if err != nil {
+				return errors.Wrap(err, "can not rotate event stream")
+			}
+		}
+	}
+
+	// The record is written in one go so a crash is less likely to split it
+	record := make([]byte, 0, 8+len(b))
+	record = binary.BigEndian.AppendUint32(record, uint32(len(b))|flags|checkedRecord)
+	record = binary.BigEndian.AppendUint32(record, crc32.Checksum(b, crcTable))
+	record = append(record, b...)
+	bytesWritten, err := s.commit.write(s.writer, record)
+	if err != nil {
+		return err
 	}
 	s.estimator.OnWriteData(int64(bytesWritten))
-	s.totalBytesWritten += int64(bytesWritten)
 
-	if s.estimator.ShouldTryFlush() || time.Since(s.lastFlush) > 10*time.Second {
-		// Chunk this and start a new event stream
-		err = s.FlushSink(event.Timestamp)
-		if err != nil {
-			return true, errors.Wrap(err, "can not flush sink")
-		}
-		s.lastFlush = time.Now()
+	if s.log.Events == 0 {
+		s.log.Started = time.Now()
+		s.log.First = first
 	}
+	s.log.Last = last
+	s.log.Events += count
+	s.log.Bytes += int64(bytesWritten)
 
-	return false, nil
+	return nil
 }
 
 func eventKey(t time.Time) string {
@@ -88,72 +187,198 @@ func eventKey(t time.Time) string {
 	return "events/" + formatted + ".events"
 }
 
-func NewSink(s storage.System, i Index, chunkTargetSize int64, maxChunkAge time.Duration, logger telemetry.Logger, metrics telemetry.Metrics) Sink {
-	key := eventKey(time.Now().UTC())
+func NewSink(ctx context.Context, s storage.System, i Index, chunkTargetSize int64, maxChunkAge time.Duration, options Options, logger telemetry.Logger, metrics telemetry.Metrics) Sink {
+	keyTime := time.Now().UTC()
+	key := eventKey(keyTime)
 
 	logger.Debug(fmt.Sprintf("Begin stream %s", key))
-	writer := s.BeginStream(context.Background(), key)
+	writer := s.BeginStream(ctx, key)
 
-	meta, err := NewMeta(s)
-	if err != nil {
-		return nil
+	if options.FlushPolicy == nil {
+		options.FlushPolicy = DefaultFlushPolicy
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultQueueSize
 	}
 
-	return &sink{
+	sink := &sink{
+		ctx:             ctx,
 		key:             key,
+		keyTime:         keyTime,
 		writer:          writer,
 		store:           s,
 		index:           i,
 		estimator:       misc.NewCompressionEstimator(chunkTargetSize),
 		chunkTargetSize: chunkTargetSize,
 		maxChunkAge:     maxChunkAge,
-		meta:            meta,
+		options:         options,
+		commit:          newGroupCommit(options.Durability, logger),
 		logger:          logger,
 		metrics:         metrics,
+		queue:           make(chan chunkJob, options.QueueSize),
+		taken:           make(chan struct{}, 1),
 	}
+	sink.worker.Add(1)
+	go sink.work()
+
+	return sink
 }
 
-func (s *sink) FlushSink(timestamp time.Time) error {
-	s.logger.Debug(fmt.Sprintf("FlushSink %v", timestamp))
-	// We close the event stream, because we think we have the events
-	err := s.writer.Close()
+// Flush implements Sink.  Every event written so far is chunked regardless of size,
+// it returns once the chunk is in the index.
+func (s *sink) Flush(ctx context.Context, timestamp time.Time) error {
+	if s.closed {
+		return ErrSinkClosed
+	}
+
+	err := s.waitForQueue(ctx)
 	if err != nil {
-		return errors.Wrap(err, "can not close event stream")
+		return err
+	}
+	done := make(chan error, 1)
+	err = s.rotate(ctx, timestamp, 0, done)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "can not wait for chunk")
+	}
+}
+
+// Close implements Sink.  The current event stream is closed and left in storage to
+// be chunked the next time the map is opened, queued streams are chunked first.
+func (s *sink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.commit.closing()
+	if err == nil {
+		err = errors.Wrap(s.writer.Close(), "can not close event stream")
 	}
-	// Make sure we start the stream again
-	defer func() {
-		key := eventKey(timestamp.UTC().Add(time.Nanosecond))
 
-		s.logger.Debug(fmt.Sprintf("Beginning a new stream %v", key))
-		s.writer = s.store.BeginStream(context.Background(), key)
-		s.key = key
-	}()
+	close(s.queue)
+	s.worker.Wait()
+	return err
+}
+
+// waitForQueue waits until the worker has room for another job
+func (s *sink) waitForQueue(ctx context.Context) error {
+	if len(s.queue) == cap(s.queue) {
+		s.metrics.AdjustCount("chunk_queue_full", 1)
+	}
+	for len(s.queue) == cap(s.queue) {
+		select {
+		case <-s.taken:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "can not wait for the chunk queue")
+		}
+	}
+	return nil
+}
 
-	// We may have more than 1 event file
-	keys, err := s.meta.GetEventFiles()
+// rotate closes the event stream, queues it to be chunked and starts a new one
+func (s *sink) rotate(ctx context.Context, timestamp time.Time, minimumChunkSize int64, done chan error) error {
+	s.logger.Debug(fmt.Sprintf("Rotate %v", timestamp))
+	err := s.commit.closing()
 	if err != nil {
-		return errors.Wrap(err, "can not get event files")
+		return err
+	}
+	err = s.writer.Close()
+	if err != nil {
+		return errors.Wrap(err, "can not close event stream")
+	}
+
+	// The stream being replaced may not have been chunked yet, so don't reuse its name
+	keyTime := timestamp.UTC().Add(time.Nanosecond)
+	if !keyTime.After(s.keyTime) {
+		keyTime = s.keyTime.Add(time.Nanosecond)
+	}
+	key := eventKey(keyTime)
+	s.logger.Debug(fmt.Sprintf("Beginning a new stream %v", key))
+	// A stream nothing was written to has nothing to chunk
+	if s.log.Events > 0 {
+		s.unqueued = append(s.unqueued, s.key)
+	} else {
+		err = s.store.Delete(ctx, s.key)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("can not delete empty event stream %s", s.key), err)
+		}
 	}
+	s.writer = s.store.BeginStream(s.ctx, key)
+	s.key = key
+	s.keyTime = keyTime
+	s.log = LogState{}
+
+	// Streams that can't be queued now go with the next job
+	select {
+	case s.queue <- chunkJob{keys: s.unqueued, minimumChunkSize: minimumChunkSize, done: done}:
+		s.busy.Add(1)
+		s.unqueued = nil
+		s.metrics.SetGuage("chunk_queue_depth", float64(len(s.queue)))
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "can not queue event stream")
+	}
+}
+
+// work chunks queued event logs in order.  Logs that were too small, or failed, are
+// tried again with the next job.
+func (s *sink) work() {
+	defer s.worker.Done()
+
+	leftover := []string{}
+	for job := range s.queue {
+		select {
+		case s.taken <- struct{}{}:
+		default:
+		}
+
+		keys := append(leftover, job.keys...)
+		leftover = []string{}
+		err := s.chunk(keys, job.minimumChunkSize)
+		if errors.Is(err, ErrSinkTooSmall) {
+			leftover, err = keys, nil
+		} else if err != nil {
+			s.logger.Error("can not build chunk", err)
+			s.metrics.AdjustCount("chunk_build_errors", 1)
+			leftover = keys
+		}
+		s.busy.Add(-1)
 
-	estimatedSize, err := processOldSinks(s.logger, s.store, s.index, s.chunkTargetSize, keys)
+		if job.done != nil {
+			job.done <- err
+		}
+	}
+}
+
+func (s *sink) chunk(keys []string, minimumChunkSize int64) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	lock := storage.EventLock(s.store)
+	lock.Lock()
+	estimatedSize, err := processOldSinks(s.ctx, s.logger, s.store, s.index, s.options, minimumChunkSize, keys)
+	lock.Unlock()
 	if errors.Is(err, ErrSinkTooSmall) {
 		s.estimator.OnFlush(estimatedSize, false)
-		return nil // We didn't process them because they were not large enough
+		return err // We didn't process them because they were not large enough
 	}
 	if err != nil {
 		return errors.Wrap(err, "can not process old sinks")
 	}
 	s.estimator.OnFlush(estimatedSize, true)
-
-	s.totalBytesWritten = 0
-
 	return nil
 }
 
-func ProcessOldSinks(logger telemetry.Logger, s storage.System, index Index) error {
+func ProcessOldSinks(ctx context.Context, logger telemetry.Logger, s storage.System, index Index, options Options) error {
 	// Read any old log sinks, clean them up and store
 	// them as chunks
-	keys, err := s.GetKeysWithPrefix(context.Background(), "events/")
+	keys, err := s.GetKeysWithPrefix(ctx, "events/")
 	if err != nil {
 		return errors.Wrap(err, "can not get keys with prefix")
 	}
@@ -161,104 +386,157 @@ func ProcessOldSinks(logger telemetry.Logger, s storage.System, index Index) err
 		return nil
 	}
 
-	_, err = processOldSinks(logger, s, index, 0, keys)
+	_, err = processOldSinks(ctx, logger, s, index, options, 0, keys)
 	return errors.Wrap(err, "can not process old sinks")
 }
 
 var ErrSinkTooSmall = errors.New("sink to small")
 
-func GetEvents(s storage.System, eventFile string) ([]Event, error) {
+func GetEvents(ctx context.Context, s storage.System, eventFile string) ([]Event, error) {
+	data, err := s.Read(ctx, eventFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not read event file")
+	}
 
-	// Read all the events so far
-	var events []Event
+	events, good, err := decodeRecords(data)
+	if err != nil {
+		return events, errors.Wrapf(err, "%s at offset %d", eventFile, good)
+	}
+	return events, nil
+}
 
-	data, err := s.Read(context.Background(), eventFile)
+// recoverEvents is GetEvents for an event log that may end in a torn write.  The log is
+// truncated to the last good record and what was dropped is logged.
+func recoverEvents(ctx context.Context, logger telemetry.Logger, s storage.System, eventFile string) ([]Event, error) {
+	data, err := s.Read(ctx, eventFile)
 	if err != nil {
-		return events, errors.Wrap(err, "can not read event file")
+		return nil, errors.Wrap(err, "can not read event file")
+	}
+
+	events, good, err := decodeRecords(data)
+	if err == nil {
+		return events, nil
 	}
-	reader := bytes.NewReader(data)
+	logger.Error(fmt.Sprintf("Dropping %d bytes from %s after offset %d, %d events kept", len(data)-good, eventFile, good, len(events)), err)
 
-	for reader.Len() > 0 {
-		var length uint32
+	err = s.Write(ctx, eventFile, data[:good])
+	if err != nil {
+		return nil, errors.Wrap(err, "can not truncate event file")
+	}
+	return events, nil
+}
 
-		// Read the length (first 4 bytes)
-		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
-			return events, errors.Wrap(err, "can not read event length")
+// decodeRecords returns the events in data up to the first bad record, and the offset
+// that record starts at
+func decodeRecords(data []byte) ([]Event, int, error) {
+	var events []Event
+	offset := 0
+
+	for offset < len(data) {
+		rest := data[offset:]
+		if len(rest) < 4 {
+			return events, offset, errors.Wrap(ErrTornRecord, "can not read event length")
 		}
+		length := binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
 
-		// Read the actual data of 'length' bytes
-		content := make([]byte, length)
-		if _, err := reader.Read(content); err != nil {
-			return events, errors.Wrap(err, "can not read event content")
+		var checksum uint32
+		if length&checkedRecord != 0 {
+			if len(rest) < 4 {
+				return events, offset, errors.Wrap(ErrTornRecord, "can not read event checksum")
+			}
+			checksum = binary.BigEndian.Uint32(rest)
+			rest = rest[4:]
 		}
 
-		var e Event
-		err := misc.DecodeFromBytes(content, &e)
-		if err != nil {
-			return events, errors.Wrap(err, "can not decode event")
+		size := int(length &^ recordFlags)
+		if len(rest) < size {
+			return events, offset, errors.Wrap(ErrTornRecord, "can not read event content")
 		}
-		events = append(events, e)
+		content := rest[:size]
+		if length&checkedRecord != 0 && crc32.Checksum(content, crcTable) != checksum {
+			return events, offset, errors.Wrap(ErrTornRecord, "event checksum mismatch")
+		}
+
+		if length&batchRecord != 0 {
+			var batch []Event
+			err := misc.DecodeFromBytes(content, &batch)
+			if err != nil {
+				return events, offset, errors.Mark(errors.Wrap(err, "can not decode event batch"), ErrTornRecord)
+			}
+			events = append(events, batch...)
+		} else {
+			var e Event
+			err := misc.DecodeFromBytes(content, &e)
+			if err != nil {
+				return events, offset, errors.Mark(errors.Wrap(err, "can not decode event"), ErrTornRecord)
+			}
+			events = append(events, e)
+		}
+
+		offset = len(data) - len(rest) + size
 	}
 
-	return events, nil
+	return events, offset, nil
 }
 
-func processOldSinks(logger telemetry.Logger, s storage.System, index Index, minimumChunkSize int64, keys []string) (int64, error) {
+func processOldSinks(ctx context.Context, logger telemetry.Logger, s storage.System, index Index, options Options, minimumChunkSize int64, keys []string) (int64, error) {
 	logger.Debug("ProcessoldSinks")
 
 	// Read all the events so far
+	read := GetEvents
+	if options.Recover {
+		read = func(ctx context.Context, s storage.System, key string) ([]Event, error) {
+			return recoverEvents(ctx, logger, s, key)
+		}
+	}
+
 	var events []Event
+	logs := map[string][]Event{}
 	for _, key := range keys {
-		e, err := GetEvents(s, key)
+		e, err := read(ctx, s, key)
+		if errors.Is(err, storage.ErrDoesNotExist) {
+			continue // Chunked by another map opened on this storage
+		}
 		if err != nil {
 			return 0, errors.Wrap(err, "can not get events")
 		}
 		events = append(events, e...)
+		logs[key] = e
 	}
 
 	var estimatedSize int64
-	var err error
 	logger.Debug(fmt.Sprintf("Event Count: %v", len(events)))
 
 	if len(events) > 0 {
 
 		// Sort all the events
-		sort.Slice(events, func(i, j int) bool {
+		sort.SliceStable(events, func(i, j int) bool {
 			return events[i].Timestamp.Before(events[j].Timestamp)
 		})
 
-		state := map[string][]byte{}
-
-		// Find the events that make up the initial keyframe, they will have the same timestamp
-		// as the first event
-		start := events[0].Timestamp
-		buildKeyframe := true
+		// The keyframe carries over the state the previous chunk ended with, so a chunk can
+		// answer for any key, and when it was written, without looking at the chunks before it
+		keyFrame, err := index.GetKeyFrameAt(ctx, index.GetMaxTime())
+		if err != nil {
+			return 0, errors.Wrap(err, "can not get previous state")
+		}
 
-		chunk := chunks.NewChunk(start)
-		var keyFrame chunks.KeyFrame
-		toFinish := []chunks.Event{}
+		chunk := chunks.NewChunk(events[0].Timestamp)
+		chunk.Data.Seeded = true
+		toFinish := make([]chunks.Event, 0, len(events))
 		for _, e := range events {
-			if buildKeyframe && e.Timestamp != start {
-				buildKeyframe = false
-				keyFrame = chunks.NewKeyFrame(state)
-			}
-			if e.Timestamp == start {
-				e.Apply(state)
-			} else {
-				toFinish = append(toFinish, chunks.Event{
-					Timestamp: e.Timestamp,
-					Key:       e.Key,
-					Data:      e.Data,
-					Delete:    e.Delete,
-				})
-			}
-		}
-		if buildKeyframe {
-			keyFrame = chunks.NewKeyFrame(state)
+			toFinish = append(toFinish, chunks.Event{
+				Timestamp: e.Timestamp,
+				Key:       e.Key,
+				Data:      e.Data,
+				Delete:    e.Delete,
+			})
 		}
-		chunk.Finish(keyFrame, toFinish)
+		chunk.Finish(keyFrame, toFinish, options.Checkpoints)
 
-		estimatedSize, err = chunk.EstimateSize()
+		// The keyframe is carried over whatever the chunk's size, only the events count
+		estimatedSize, err = chunk.EventSize()
 		if estimatedSize < int64(float64(minimumChunkSize)*0.9) || err != nil {
 			logger.Debug(fmt.Sprintf("Not enough data to chunk %v < %v", estimatedSize, int64(float64(minimumChunkSize)*0.9)))
 
@@ -266,19 +544,37 @@ func processOldSinks(logger telemetry.Logger, s storage.System, index Index, min
 		}
 		logger.Debug(fmt.Sprintf("Enough data to chunk %v >= %v", estimatedSize, int64(float64(minimumChunkSize)*0.9)))
 
-		err = chunk.Save(context.Background(), s)
+		// Building the chunk can take a while, don't persist it if the caller has gone away
+		if err := ctx.Err(); err != nil {
+			return estimatedSize, errors.Wrap(err, "can not save chunk")
+		}
+
+		if options.RetainEvents {
+			err = retainEventLogs(ctx, s, logs)
+			if err != nil {
+				return estimatedSize, errors.Wrap(err, "can not retain event logs")
+			}
+		}
+
+		err = chunk.Save(ctx, s)
 		if err != nil {
 			return estimatedSize, errors.Wrap(err, "can not save chunk")
 		}
 
-		err = index.UpdateIndex(chunk.Header)
+		err = index.UpdateIndex(ctx, chunk.Header)
 		if err != nil {
 			return estimatedSize, errors.Wrap(err, "can not update index")
 		}
+
+		err = updateExpirations(ctx, s, events)
+		if err != nil {
+			return estimatedSize, errors.Wrap(err, "can not update expirations")
+		}
 	}
 
+	// The events are in the index now, they have to be removed even if the caller has gone away
 	for _, key := range keys {
-		s.Delete(context.Background(), key)
+		s.Delete(context.WithoutCancel(ctx), key)
 	}
 
 	return estimatedSize, nil
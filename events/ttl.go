@@ -0,0 +1,69 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/hoyle1974/temporal/misc"
+	"github.com/hoyle1974/temporal/storage"
+)
+
+// Keys with a pending expiry are kept here once their events have been chunked
+const expirationsKey = "ttl.idx"
+
+// LoadExpirations returns when each key with a pending expiry should be removed
+func LoadExpirations(ctx context.Context, s storage.System) (map[string]time.Time, error) {
+	expirations := map[string]time.Time{}
+
+	b, err := s.Read(ctx, expirationsKey)
+	if errors.Is(err, storage.ErrDoesNotExist) {
+		return expirations, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can not read expirations")
+	}
+	if len(b) == 0 {
+		return expirations, nil
+	}
+
+	err = misc.DecodeFromBytes(b, &expirations)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not decode expirations")
+	}
+	return expirations, nil
+}
+
+// updateExpirations applies events, in timestamp order, to the stored expirations.  Any
+// write to a key replaces its expiry.
+func updateExpirations(ctx context.Context, s storage.System, events []Event) error {
+	expirations, err := LoadExpirations(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, e := range events {
+		if !e.Expires.IsZero() {
+			expirations[e.Key] = e.Expires
+			changed = true
+		} else if _, ok := expirations[e.Key]; ok {
+			delete(expirations, e.Key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	b, err := misc.EncodeToBytes(expirations)
+	if err != nil {
+		return errors.Wrap(err, "can not encode expirations")
+	}
+	err = s.Write(ctx, expirationsKey, b)
+	if err != nil {
+		return errors.Wrap(err, "can not write expirations")
+	}
+	return nil
+}
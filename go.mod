@@ -41,7 +41,6 @@ require (
 	github.com/cockroachdb/errors v1.11.3
 	github.com/gabstv/go-bsdiff v1.0.5
 	github.com/google/uuid v1.6.0
-	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/spf13/pflag v1.0.6
 	github.com/stretchr/testify v1.8.2
 )
@@ -2,6 +2,9 @@ package temporal
 
 import (
 	"context"
+	"maps"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
@@ -19,13 +22,63 @@ import (
 // you can't go back in time to do writes with this system
 type Write interface {
 	Set(ctx context.Context, timestamp time.Time, key string, data []byte) error
+	SetWithTTL(ctx context.Context, timestamp time.Time, key string, data []byte, ttl time.Duration) error
 	Del(ctx context.Context, timestamp time.Time, key string) error
+	Apply(ctx context.Context, timestamp time.Time, ops ...Op) error
+}
+
+// Op is a single write in a batch passed to Apply
+type Op struct {
+	Key    string
+	Data   []byte
+	Delete bool
+}
+
+func SetOp(key string, data []byte) Op {
+	return Op{Key: key, Data: data}
+}
+
+func DelOp(key string) Op {
+	return Op{Key: key, Delete: true}
 }
 
 // Reads can read from any point in time
 type Read interface {
 	Get(ctx context.Context, timestamp time.Time, key string) ([]byte, error)
 	GetAll(ctx context.Context, timestamp time.Time) (map[string][]byte, error)
+	History(ctx context.Context, key string, from time.Time, to time.Time) ([]Version, error)
+	GetRange(ctx context.Context, timestamp time.Time, startKey string, endKey string) ([]KeyValue, error)
+	GetPrefix(ctx context.Context, timestamp time.Time, prefix string) ([]KeyValue, error)
+	Changes(ctx context.Context, from time.Time, to time.Time) ([]Change, error)
+	Snapshot(ctx context.Context, timestamp time.Time) (Snapshot, error)
+}
+
+type KeyValue struct {
+	Key  string
+	Data []byte
+}
+
+type ChangeType int
+
+const (
+	Created ChangeType = iota
+	Modified
+	Deleted
+)
+
+// Change describes how a key differs between the start and end of a window of time
+type Change struct {
+	Key    string
+	Type   ChangeType
+	Before []byte
+	After  []byte
+}
+
+// Version is a value a key held starting at Timestamp
+type Version struct {
+	Timestamp time.Time
+	Data      []byte
+	Delete    bool
 }
 
 type Meta interface {
@@ -34,12 +87,37 @@ type Meta interface {
 	GetMinMaxTime() (time.Time, time.Time)
 }
 
+// Watch delivers writes as they happen
+type Watch interface {
+	Subscribe(ctx context.Context, prefix string, since time.Time) (Subscription, error)
+}
+
+// Lifecycle controls when buffered events are persisted and when the map is released
+type Lifecycle interface {
+	Flush(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Maintenance rewrites and removes chunks that have already been written
+type Maintenance interface {
+	Compact(ctx context.Context) error
+	Downsample(ctx context.Context) error
+	Retain(ctx context.Context, dryRun bool) (RetentionReport, error)
+}
+
 type ReadWriteMap interface {
 	Write
+	ConditionalWrite
 	Read
+	Watch
 	Meta
+	Lifecycle
+	Maintenance
 }
 
+// ErrMapClosed is returned by every call made after Close
+var ErrMapClosed = errors.New("map closed")
+
 /*
 We want to store data in S3
 
@@ -54,54 +132,260 @@ type temporalMap struct {
 	eventSink events.Sink
 	current   time.Time
 	data      map[string][]byte
+	versions  map[string]time.Time // When each key was last written, filled lazily
 	minTime   time.Time
+	closed    bool
+	logger    telemetry.Logger
+
+	// Keys written with a ttl and when they expire
+	expirations map[string]time.Time
+	expiryQueue expiryQueue
+	expiryTimer *time.Timer
+	nextExpiry  time.Time
+
+	chunkTargetSize  int64
+	checkpoints      chunks.Checkpoints
+	downsample       []chunks.DownsamplePolicy
+	retention        chunks.RetentionPolicy
+	flushOnClose     bool
+	subscribers      map[*subscriber]struct{}
+	subscriberBuffer int
 }
 
+// MapConfig configures a map opened with NewMapWithConfig.  However it is configured the
+// map builds chunks in the background and must be closed with Close.
 type MapConfig struct {
 	MaxChunkTargetSize int64
 	MaxChunkAge        time.Duration
 	Metrics            telemetry.Metrics
 	Logger             telemetry.Logger
+	SubscriberBuffer   int  // How many events a subscriber may fall behind before it overflows
+	FlushOnClose       bool // Chunk any buffered events when the map is closed
+	CheckpointDiffs    int  // Store a key's full value in a chunk after this many diffs
+	CheckpointBytes    int  // Store a key's full value in a chunk once its diffs reach this size
+	Downsample         []DownsamplePolicy
+	DiffCodec          chunks.DiffCodec // How chunks store changes to a value, nil picks one by the value's size
+	Retention          RetentionPolicy  // Applied whenever a chunk is written, MaxChunkAge is its default MaxAge
+	Archive            storage.System   // Chunks are copied here before retention removes them
+	OnCorrupt          CorruptionMode   // RebuildCorrupt keeps every event log so chunks can be built again
+	ChunkCacheBytes    int64            // How much memory decoded chunks may use, least recently used are evicted first
+	RecoverEventLogs   bool             // Open even if an event log ends in a torn write, dropping the torn records
+	Durability         Durability       // When writes to the event log are synced to storage, S3 only supports SyncNone
+	ChunkQueue         int              // Event logs that may wait to be chunked before writes block, defaults to 4
+	FlushPolicy        FlushPolicy      // When buffered events are chunked, by default once MaxChunkTargetSize is reached
+}
+
+// Durability decides when writes are synced to storage.  SyncEveryWrite syncs before a
+// write is acknowledged.  SyncGroup acknowledges writes straight away and syncs once
+// Bytes have been written or Interval after the first unsynced write, whichever is
+// first, so a crash can lose the writes acknowledged since the last sync.
+type Durability = events.Durability
+
+type DurabilityMode = events.DurabilityMode
+
+const (
+	SyncNone       = events.SyncNone
+	SyncEveryWrite = events.SyncEveryWrite
+	SyncGroup      = events.SyncGroup
+)
+
+// FlushPolicy decides when buffered events are chunked, it is asked before each write.
+// The built-in policies can be combined with FlushAny.
+type FlushPolicy = events.FlushPolicy
+
+type LogState = events.LogState
+
+type FlushDecision = events.FlushDecision
+
+const (
+	KeepWriting = events.KeepWriting
+	TryFlush    = events.TryFlush
+	FlushNow    = events.FlushNow
+)
+
+type (
+	FlushOnSize     = events.FlushOnSize
+	FlushOnAge      = events.FlushOnAge
+	FlushOnCount    = events.FlushOnCount
+	FlushOnBoundary = events.FlushOnBoundary
+)
+
+var FlushAny = events.FlushAny
+
+// CorruptionMode decides what happens when a chunk fails its checksum
+type CorruptionMode = chunks.CorruptionMode
+
+const (
+	FailOnCorrupt       = chunks.FailOnCorrupt
+	RebuildCorrupt      = chunks.RebuildCorrupt
+	UnreadableOnCorrupt = chunks.UnreadableOnCorrupt
+)
+
+// ErrCorrupt matches every CorruptError, which names the chunk that is corrupt
+var ErrCorrupt = chunks.ErrCorrupt
+
+type CorruptError = chunks.CorruptError
+
+// DownsamplePolicy keeps only the last version of each key in every Bucket for data
+// older than Age, measured back from the newest chunked data
+type DownsamplePolicy = chunks.DownsamplePolicy
+
+// RetentionPolicy decides which chunks are kept, a zero field doesn't limit anything.  The
+// oldest chunks are removed first and the newest chunk is always kept.
+type RetentionPolicy = chunks.RetentionPolicy
+
+// PrefixRetention drops the history of keys starting with Prefix once it is older than MaxAge
+type PrefixRetention = chunks.PrefixRetention
+
+// RetentionReport lists the chunks a retention pass removed or rewrote, or would have on a dry run
+type RetentionReport struct {
+	Removed   []string
+	Rewritten []string
+	Bytes     int64
 }
 
+const (
+	defaultCheckpointDiffs = 64
+	defaultCheckpointBytes = 256 * 1024
+	defaultChunkCacheBytes = 64 * 1024 * 1024
+)
+
+// NewMap opens the map kept in storage.  Close must be called once it is no longer used,
+// it waits for the chunks being built in the background and stops the worker building
+// them.  Event logs that weren't chunked are chunked the next time the map is opened.
 func NewMap(storage storage.System) (ReadWriteMap, error) {
 	return NewMapWithConfig(storage, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024})
 }
 
+// lockEvents holds the lock s has for chunking event logs until the returned func is called
+func lockEvents(s storage.System) func() {
+	lock := storage.EventLock(s)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// NewMapWithConfig is NewMap with a MapConfig, the map must be closed with Close too
 func NewMapWithConfig(storage storage.System, config MapConfig) (ReadWriteMap, error) {
+	err := config.Durability.Supported(storage)
+	if err != nil {
+		return nil, err
+	}
+	if config.DiffCodec != nil {
+		err = chunks.CheckDiffCodec(config.DiffCodec)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if config.Logger == nil {
 		config.Logger = telemetry.NOPLogger{}
 	}
 	if config.Metrics == nil {
 		config.Metrics = telemetry.NOPMetrics{}
 	}
+	if config.SubscriberBuffer <= 0 {
+		config.SubscriberBuffer = defaultSubscriberBuffer
+	}
+	if config.CheckpointDiffs <= 0 {
+		config.CheckpointDiffs = defaultCheckpointDiffs
+	}
+	if config.CheckpointBytes <= 0 {
+		config.CheckpointBytes = defaultCheckpointBytes
+	}
+	if config.ChunkCacheBytes <= 0 {
+		config.ChunkCacheBytes = defaultChunkCacheBytes
+	}
+	checkpoints := chunks.Checkpoints{Diffs: config.CheckpointDiffs, Bytes: config.CheckpointBytes, Codec: config.DiffCodec}
+	if config.Retention.MaxAge == 0 {
+		config.Retention.MaxAge = config.MaxChunkAge
+	}
+	options := events.Options{
+		Checkpoints:  checkpoints,
+		RetainEvents: config.OnCorrupt == RebuildCorrupt,
+		Recover:      config.RecoverEventLogs,
+		Durability:   config.Durability,
+		QueueSize:    config.ChunkQueue,
+		FlushPolicy:  config.FlushPolicy,
+	}
+	corruption := chunks.Corruption{
+		Mode: config.OnCorrupt,
+		Events: func(ctx context.Context, from time.Time, to time.Time) ([]chunks.Event, error) {
+			return events.RetainedEvents(ctx, storage, from, to)
+		},
+		Release: func(ctx context.Context, before time.Time) error {
+			return events.ReleaseRetainedEvents(ctx, storage, before)
+		},
+	}
+
+	// The map outlives any one request, so opening it and its event streams isn't tied to one
+	ctx := context.Background()
+
+	// A map on the same storage that wasn't closed may still be chunking
+	unlock := lockEvents(storage)
+	defer unlock()
 
 	// Build/Load indexes
-	index, err := chunks.NewChunkIndex(storage, config.MaxChunkAge, config.Logger, config.Metrics)
+	index, err := chunks.NewChunkIndex(ctx, storage, config.Retention, config.Archive, checkpoints, corruption, config.ChunkCacheBytes, config.Logger, config.Metrics)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create index")
 	}
 
 	// Load current events in the event synk
-	err = events.ProcessOldSinks(config.Logger, storage, index)
+	err = events.ProcessOldSinks(ctx, config.Logger, storage, index, options)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not process old sinks")
 	}
 
-	keys, err := index.GetStateAt(time.Now())
+	expirations, err := events.LoadExpirations(ctx, storage)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load expirations")
+	}
+
+	keys, err := index.GetStateAt(ctx, index.GetMaxTime())
 	if err != nil {
 		return nil, errors.Wrap(err, "could not get state at time")
 	}
 
-	return &temporalMap{
-		storage:   storage,
-		index:     index,
-		eventSink: events.NewSink(storage, index, config.MaxChunkTargetSize, config.MaxChunkAge, config.Logger, config.Metrics),
-		data:      keys,
-		current:   time.Now(),
-		minTime:   index.GetMinTime(),
-		eventMap:  temporal.New(),
-	}, nil
+	t := &temporalMap{
+		storage:     storage,
+		index:       index,
+		eventSink:   events.NewSink(ctx, storage, index, config.MaxChunkTargetSize, config.MaxChunkAge, options, config.Logger, config.Metrics),
+		data:        keys,
+		versions:    map[string]time.Time{},
+		current:     index.GetMaxTime(),
+		minTime:     index.GetMinTime(),
+		eventMap:    temporal.New(),
+		logger:      config.Logger,
+		expirations: map[string]time.Time{},
+
+		chunkTargetSize:  config.MaxChunkTargetSize,
+		checkpoints:      checkpoints,
+		downsample:       config.Downsample,
+		retention:        config.Retention,
+		flushOnClose:     config.FlushOnClose,
+		subscribers:      map[*subscriber]struct{}{},
+		subscriberBuffer: config.SubscriberBuffer,
+	}
+
+	// The expiry timer can fire as soon as it is armed
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Keys that expired while we were down are deleted at the time they expired
+	now := time.Now()
+	for key, expires := range expirations {
+		t.setExpiry(key, expires)
+	}
+	err = t.expire(ctx, now)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not expire keys")
+	}
+
+	// Data may have been written with timestamps ahead of the clock
+	if now.After(t.current) {
+		t.current = now
+	}
+
+	return t, nil
 }
 
 // Get implements ReadWriteMap.
@@ -109,23 +393,33 @@ func (t *temporalMap) Get(ctx context.Context, timestamp time.Time, key string)
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
+	if t.closed {
+		return nil, ErrMapClosed
+	}
+
+	return t.get(ctx, timestamp, key)
+}
+
+func (t *temporalMap) get(ctx context.Context, timestamp time.Time, key string) ([]byte, error) {
 	if timestamp.IsZero() || !timestamp.Before(t.current) {
+		if t.expired(key, timestamp) {
+			return nil, nil
+		}
 		return t.data[key], nil
 	}
 
-	// TODO might we be looking at unindex data?
-	min, max := t.eventMap.GetTimeRange()
-	if (min.Equal(timestamp) || timestamp.After(min)) && (max.Equal(timestamp) || timestamp.Before(max)) {
-		data := t.eventMap.GetItem(timestamp, key)
-		return data, nil
+	// The event map has every write since the last chunk was added to the index, if it
+	// doesn't know the key then it was last written before that and is in the index
+	if e, ok := t.eventMap.GetLatest(timestamp, key); ok {
+		return e.Value, nil
 	}
 
-	state, err := t.index.GetStateAt(timestamp)
+	value, err := t.index.GetValueAt(ctx, timestamp, key)
 	if err != nil {
-		return nil, errors.Wrap(err, "can not get state at time")
+		return nil, errors.Wrap(err, "can not get value at time")
 	}
 
-	return state[key], nil
+	return value, nil
 }
 
 // GetAll implements ReadWriteMap.
@@ -133,68 +427,265 @@ func (t *temporalMap) GetAll(ctx context.Context, timestamp time.Time) (map[stri
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	if timestamp.IsZero() || !timestamp.Before(t.current) {
-		return misc.DeepCopyMap(t.data), nil
+	if t.closed {
+		return nil, ErrMapClosed
+	}
+
+	return t.getRangeStateAt(ctx, timestamp, misc.KeyRange{})
+}
+
+// GetRange implements ReadWriteMap.  It returns the keys in [startKey, endKey) in sorted
+// order, an empty endKey has no upper bound.
+func (t *temporalMap) GetRange(ctx context.Context, timestamp time.Time, startKey string, endKey string) ([]KeyValue, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return nil, ErrMapClosed
+	}
+
+	state, err := t.getRangeStateAt(ctx, timestamp, misc.KeyRange{Start: startKey, End: endKey})
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeyValues(state), nil
+}
+
+// GetPrefix implements ReadWriteMap.  It returns the keys starting with prefix in sorted order.
+func (t *temporalMap) GetPrefix(ctx context.Context, timestamp time.Time, prefix string) ([]KeyValue, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return nil, ErrMapClosed
+	}
+
+	state, err := t.getRangeStateAt(ctx, timestamp, misc.PrefixRange(prefix))
+	if err != nil {
+		return nil, err
 	}
+	return sortedKeyValues(state), nil
+}
 
-	min, max := t.eventMap.GetTimeRange()
-	if (min.Equal(timestamp) || timestamp.After(min)) && (max.Equal(timestamp) || timestamp.Before(max)) {
-		state := t.eventMap.GetStateAtTime(timestamp)
+func (t *temporalMap) getRangeStateAt(ctx context.Context, timestamp time.Time, r misc.KeyRange) (map[string][]byte, error) {
+	if timestamp.IsZero() || !timestamp.Before(t.current) {
+		if r.IsAll() && len(t.expirations) == 0 {
+			return misc.DeepCopyMap(t.data), nil
+		}
+		state := map[string][]byte{}
+		for k, v := range t.data {
+			if r.Contains(k) && !t.expired(k, timestamp) {
+				state[k] = v
+			}
+		}
 		return state, nil
 	}
 
-	state, err := t.index.GetStateAt(timestamp)
+	state, err := t.index.GetRangeStateAt(ctx, timestamp, r)
 	if err != nil {
 		return nil, errors.Wrap(err, "can not get state at time")
 	}
 
+	// Writes that haven't been chunked yet win over the index
+	for key, e := range t.eventMap.GetRangeLatest(timestamp, r) {
+		if e.Value == nil {
+			delete(state, key)
+		} else {
+			state[key] = e.Value
+		}
+	}
+
 	return state, nil
+}
+
+func sortedKeyValues(state map[string][]byte) []KeyValue {
+	ret := make([]KeyValue, 0, len(state))
+	for _, k := range slices.Sorted(maps.Keys(state)) {
+		ret = append(ret, KeyValue{Key: k, Data: state[k]})
+	}
+	return ret
+}
+
+// History implements ReadWriteMap.  It returns every version of key written between
+// from and to (inclusive), oldest first.
+func (t *temporalMap) History(ctx context.Context, key string, from time.Time, to time.Time) ([]Version, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return nil, ErrMapClosed
+	}
+
+	events, err := t.history(ctx, misc.SingleKey(key), from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(events))
+	for _, e := range events {
+		versions = append(versions, Version{Timestamp: e.Timestamp, Data: e.Data, Delete: e.Delete})
+	}
+
+	return versions, nil
+}
+
+// history returns every write to the keys in r between from and to (inclusive) from
+// both the chunks and the event map, in timestamp order.
+func (t *temporalMap) history(ctx context.Context, r misc.KeyRange, from time.Time, to time.Time) ([]chunks.Event, error) {
+	// The worker can add a chunk while the index is read, so what it had chunked is read
+	// first.  Every write after that is still in the event map.
+	indexed := t.index.GetMaxTime()
+	events, err := t.index.GetRangeHistory(ctx, r, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not get range history")
+	}
+
+	// The event map overlaps with what was chunked, including anything chunked since
+	type write struct {
+		key       string
+		timestamp int64
+	}
+	seen := map[write]bool{}
+	for _, e := range events {
+		if !e.Timestamp.Before(indexed) {
+			seen[write{e.Key, e.Timestamp.UnixNano()}] = true
+		}
+	}
+
+	tail := []chunks.Event{}
+	for key, entries := range t.eventMap.GetRangeHistory(from, to, r) {
+		for _, e := range entries {
+			if e.Timestamp.Before(indexed) || seen[write{key, e.Timestamp.UnixNano()}] {
+				continue
+			}
+			tail = append(tail, chunks.Event{Timestamp: e.Timestamp, Key: key, Data: e.Value, Delete: e.Value == nil})
+		}
+	}
+	sort.SliceStable(tail, func(i, j int) bool {
+		return tail[i].Timestamp.Before(tail[j].Timestamp)
+	})
 
+	return append(events, tail...), nil
+}
+
+// Changes implements ReadWriteMap.  It returns every key written in (from, to] in sorted
+// order along with the value it had at from and at to.  A key that was created and
+// removed within the window is not reported.
+func (t *temporalMap) Changes(ctx context.Context, from time.Time, to time.Time) ([]Change, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return nil, ErrMapClosed
+	}
+
+	// The worker can add a chunk while the index is read, so what it had chunked is read
+	// first.  Every write after that is still in the event map and replaying one that was
+	// also chunked leaves the same value.
+	indexed := t.index.GetMaxTime()
+	changes, err := t.index.GetChanges(ctx, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not get changes")
+	}
+
+	// The event map overlaps with what was chunked, only take what is newer
+	for key, entries := range t.eventMap.GetRangeHistory(from, to, misc.KeyRange{}) {
+		for _, e := range entries {
+			if !e.Timestamp.After(from) || e.Timestamp.Before(indexed) {
+				continue
+			}
+			change, ok := changes[key]
+			if !ok {
+				before, err := t.get(ctx, from, key)
+				if err != nil {
+					return nil, errors.Wrap(err, "can not get value before changes")
+				}
+				change = chunks.KeyChange{Key: key, Before: before}
+			}
+			change.After = e.Value
+			changes[key] = change
+		}
+	}
+
+	ret := make([]Change, 0, len(changes))
+	for _, key := range slices.Sorted(maps.Keys(changes)) {
+		change := changes[key]
+		switch {
+		case change.Before == nil && change.After == nil:
+			continue
+		case change.Before == nil:
+			ret = append(ret, Change{Key: key, Type: Created, After: change.After})
+		case change.After == nil:
+			ret = append(ret, Change{Key: key, Type: Deleted, Before: change.Before})
+		default:
+			ret = append(ret, Change{Key: key, Type: Modified, Before: change.Before, After: change.After})
+		}
+	}
+
+	return ret, nil
 }
 
 // Set implements ReadWriteMap.
 func (t *temporalMap) Set(ctx context.Context, timestamp time.Time, key string, data []byte) error {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	if t.current.IsZero() {
-		t.current = timestamp
+	if t.closed {
+		return ErrMapClosed
 	}
-	if timestamp.Before(t.current) {
-		return errors.New("del: cannot delete data from the past")
+
+	return t.set(ctx, timestamp, key, data, time.Time{})
+}
+
+func (t *temporalMap) set(ctx context.Context, timestamp time.Time, key string, data []byte, expires time.Time) error {
+	if err := t.advance(ctx, timestamp, "set"); err != nil {
+		return err
 	}
+	return t.put(ctx, timestamp, key, data, expires)
+}
 
-	flushed, err := t.eventSink.Append(events.Event{
+func (t *temporalMap) put(ctx context.Context, timestamp time.Time, key string, data []byte, expires time.Time) error {
+	err := t.eventSink.Append(ctx, events.Event{
 		Timestamp: timestamp,
 		Key:       key,
 		Data:      data,
 		Delete:    false,
+		Expires:   expires,
 	})
 	if err != nil {
 		return err
 	}
-	if flushed {
-		t.eventMap = temporal.New()
-	}
+	t.trimEvents()
 
 	t.data[key] = data
+	t.versions[key] = timestamp
+	t.setExpiry(key, expires)
 	t.current = timestamp
 	t.eventMap.Add(timestamp, key, data)
+	t.publish(Event{Timestamp: timestamp, Key: key, Data: data})
 
 	return nil
 }
 
-// Set implements ReadWriteMap.
+// Del implements ReadWriteMap.
 func (t *temporalMap) Del(ctx context.Context, timestamp time.Time, key string) error {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	if t.current.IsZero() {
-		t.current = timestamp
+	if t.closed {
+		return ErrMapClosed
 	}
-	if timestamp.Before(t.current) {
-		return errors.New("del: timestamp is before current")
+
+	return t.del(ctx, timestamp, key)
+}
+
+func (t *temporalMap) del(ctx context.Context, timestamp time.Time, key string) error {
+	if err := t.advance(ctx, timestamp, "del"); err != nil {
+		return err
 	}
+	return t.remove(ctx, timestamp, key)
+}
 
-	flushed, err := t.eventSink.Append(events.Event{
+func (t *temporalMap) remove(ctx context.Context, timestamp time.Time, key string) error {
+	err := t.eventSink.Append(ctx, events.Event{
 		Timestamp: timestamp,
 		Key:       key,
 		Delete:    true,
@@ -202,23 +693,214 @@ func (t *temporalMap) Del(ctx context.Context, timestamp time.Time, key string)
 	if err != nil {
 		return err
 	}
-	if flushed {
-		t.eventMap = temporal.New()
-	}
+	t.trimEvents()
 
 	delete(t.data, key)
+	t.versions[key] = timestamp
+	t.setExpiry(key, time.Time{})
 	t.current = timestamp
 	t.eventMap.Remove(timestamp, key)
+	t.publish(Event{Timestamp: timestamp, Key: key, Delete: true})
+
+	return nil
+}
+
+// trimEvents drops the writes the worker has since chunked from the event map, the index
+// has them now.  Writes at the index's max time are kept as they may be in the next chunk.
+func (t *temporalMap) trimEvents() {
+	t.eventMap.Trim(t.index.GetMaxTime())
+}
+
+// advance checks that a write at timestamp isn't in the past and removes every key that
+// expires by then, the caller must hold the lock
+func (t *temporalMap) advance(ctx context.Context, timestamp time.Time, op string) error {
+	if t.current.IsZero() {
+		t.current = timestamp
+	}
+	if timestamp.Before(t.current) {
+		return errors.Newf("%s: timestamp is before current", op)
+	}
+	return t.expire(ctx, timestamp)
+}
+
+// Apply implements ReadWriteMap.  All of the ops are written at timestamp as a single
+// record, so readers and recovery see either all of them or none of them.
+func (t *temporalMap) Apply(ctx context.Context, timestamp time.Time, ops ...Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+
+	if err := t.advance(ctx, timestamp, "apply"); err != nil {
+		return err
+	}
+
+	batch := make([]events.Event, 0, len(ops))
+	for _, op := range ops {
+		if op.Delete {
+			op.Data = nil
+		}
+		batch = append(batch, events.Event{
+			Timestamp: timestamp,
+			Key:       op.Key,
+			Data:      op.Data,
+			Delete:    op.Delete,
+		})
+	}
+
+	err := t.eventSink.AppendBatch(ctx, batch)
+	if err != nil {
+		return err
+	}
+	t.trimEvents()
+
+	published := make([]Event, 0, len(batch))
+	for _, e := range batch {
+		t.versions[e.Key] = timestamp
+		t.setExpiry(e.Key, time.Time{})
+		if e.Delete {
+			delete(t.data, e.Key)
+			t.eventMap.Remove(timestamp, e.Key)
+		} else {
+			t.data[e.Key] = e.Data
+			t.eventMap.Add(timestamp, e.Key, e.Data)
+		}
+		published = append(published, Event{Timestamp: timestamp, Key: e.Key, Data: e.Data, Delete: e.Delete})
+	}
+	t.current = timestamp
+	t.publish(published...)
+
+	return nil
+}
+
+// Flush implements ReadWriteMap.  Every buffered event is written to a chunk and added
+// to the index regardless of how small the chunk is.
+func (t *temporalMap) Flush(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+
+	err := t.eventSink.Flush(ctx, t.current)
+	if err != nil {
+		return errors.Wrap(err, "can not flush sink")
+	}
+	t.trimEvents()
+	return nil
+}
 
+// Compact implements ReadWriteMap.  Adjacent chunks smaller than half of
+// MaxChunkTargetSize are merged into chunks of up to MaxChunkTargetSize.
+func (t *temporalMap) Compact(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+
+	_, err := t.index.Compact(ctx, t.chunkTargetSize/2, t.chunkTargetSize, t.checkpoints)
+	if err != nil {
+		return errors.Wrap(err, "can not compact chunks")
+	}
+	return nil
+}
+
+// Downsample implements ReadWriteMap.  Chunks covered by the configured policies are
+// rewritten to keep one version per key per bucket, reads inside a bucket return the
+// last value written in it.
+func (t *temporalMap) Downsample(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+	if len(t.downsample) == 0 {
+		return nil
+	}
+
+	_, err := t.index.Downsample(ctx, t.downsample, t.checkpoints)
+	if err != nil {
+		return errors.Wrap(err, "can not downsample chunks")
+	}
 	return nil
 }
 
+// Retain implements ReadWriteMap.  It applies the retention policy now rather than waiting
+// for the next chunk to be written, with dryRun it only reports what would be removed.
+func (t *temporalMap) Retain(ctx context.Context, dryRun bool) (RetentionReport, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return RetentionReport{}, ErrMapClosed
+	}
+
+	report, err := t.index.ApplyRetention(ctx, t.retention, dryRun)
+	if err != nil {
+		return RetentionReport{}, errors.Wrap(err, "can not apply retention")
+	}
+
+	ret := RetentionReport{Removed: []string{}, Rewritten: []string{}, Bytes: report.Bytes}
+	for _, id := range report.Removed {
+		ret.Removed = append(ret.Removed, string(id))
+	}
+	for _, id := range report.Rewritten {
+		ret.Rewritten = append(ret.Rewritten, string(id))
+	}
+	if !dryRun {
+		t.minTime = t.index.GetMinTime()
+	}
+	return ret, nil
+}
+
+// Close implements ReadWriteMap.  The event stream is closed so nothing that was
+// acknowledged is lost, queued event logs are chunked and the chunk worker is stopped,
+// subscribers are ended and every later call returns ErrMapClosed.
+func (t *temporalMap) Close(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+	t.closed = true
+
+	var err error
+	if t.flushOnClose {
+		err = errors.Wrap(t.eventSink.Flush(ctx, t.current), "can not flush sink")
+	}
+	err = errors.CombineErrors(err, errors.Wrap(t.eventSink.Close(), "can not close sink"))
+
+	for s := range t.subscribers {
+		s.end(ErrMapClosed)
+	}
+	if t.expiryTimer != nil {
+		t.expiryTimer.Stop()
+	}
+
+	t.data = nil
+	t.versions = nil
+	t.eventMap = temporal.New()
+
+	return err
+}
+
 func (t *temporalMap) GetMinTime() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return t.minTime
 }
 func (t *temporalMap) GetMaxTime() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return t.current
 }
 func (t *temporalMap) GetMinMaxTime() (time.Time, time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return t.minTime, t.current
 }
@@ -1,15 +1,22 @@
 package temporal
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/hoyle1974/temporal/chunks"
+	"github.com/hoyle1974/temporal/events"
 	"github.com/hoyle1974/temporal/misc"
 	"github.com/hoyle1974/temporal/storage"
 )
@@ -253,6 +260,36 @@ func TestMap5(t *testing.T) {
 	}
 }
 
+// countingMetrics keeps the counts it is given so tests can look at them
+type countingMetrics struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+func (m *countingMetrics) AdjustCount(key string, value int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.counts == nil {
+		m.counts = map[string]int64{}
+	}
+	m.counts[key] += value
+}
+
+func (m *countingMetrics) SetGuage(key string, value float64) {
+}
+
+func (m *countingMetrics) count(key string) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.counts[key]
+}
+
+func (m *countingMetrics) String() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return fmt.Sprint(m.counts)
+}
+
 func Benchmark1(b *testing.B) {
 	s := storage.NewMemoryStorage()
 	//os.RemoveAll("data")
@@ -289,7 +326,8 @@ func Benchmark1(b *testing.B) {
 	}
 	end := time.Now()
 
-	m, err = NewMap(s)
+	metrics := &countingMetrics{}
+	m, err = NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, Metrics: metrics})
 	if err != nil {
 		b.Fatalf("could not create map: %v", err)
 	}
@@ -297,7 +335,6 @@ func Benchmark1(b *testing.B) {
 		b.Fatalf("map was nil")
 	}
 
-	chunks.ClearCache()
 	b.ResetTimer()
 
 	fmt.Println(b.N)
@@ -312,7 +349,7 @@ func Benchmark1(b *testing.B) {
 		}
 	}
 
-	chunks.PrintCacheStats()
+	fmt.Println(metrics)
 
 }
 
@@ -322,7 +359,8 @@ func Benchmark2(b *testing.B) {
 	os.MkdirAll("data", os.ModeDir|0755)
 	s := storage.NewDiskStorage("data")
 
-	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 4 * 8 * 1024 * 1024})
+	metrics := &countingMetrics{}
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 4 * 8 * 1024 * 1024, Metrics: metrics})
 	if err != nil {
 		b.Fatalf("could not create map: %v", err)
 	}
@@ -347,7 +385,7 @@ func Benchmark2(b *testing.B) {
 		m.Set(context.Background(), time.Now(), key, b)
 		temp += len(key) + len(b)
 	}
-	chunks.PrintCacheStats()
+	fmt.Println(metrics)
 
 	fmt.Println("Size:", float64(temp)/1024.0/1024.0)
 
@@ -496,3 +534,1999 @@ func TestMapExpiration(t *testing.T) {
 	fmt.Println(string(value))
 
 }
+
+func TestMapHistory(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	a := time.Now()
+	b := a.Add(time.Second)
+	c := a.Add(time.Second * 2)
+	d := a.Add(time.Second * 3)
+	e := a.Add(time.Second * 4)
+
+	m.Set(context.Background(), a, "foo", []byte("bar1"))
+	m.Set(context.Background(), b, "bar", []byte("foo"))
+	m.Set(context.Background(), c, "foo", []byte("bar2"))
+	m.Del(context.Background(), d, "foo")
+	m.Set(context.Background(), e, "foo", []byte("bar3"))
+
+	validate := func(m ReadWriteMap) {
+		versions, err := m.History(context.Background(), "foo", a, e)
+		if err != nil {
+			t.Fatalf("history failed: %v", err)
+		}
+		if len(versions) != 4 {
+			t.Fatalf("expected 4 versions, got %d", len(versions))
+		}
+		if string(versions[0].Data) != "bar1" || !versions[0].Timestamp.Equal(a) {
+			t.Fatalf("wrong first version: %v", versions[0])
+		}
+		if string(versions[1].Data) != "bar2" || !versions[1].Timestamp.Equal(c) {
+			t.Fatalf("wrong second version: %v", versions[1])
+		}
+		if !versions[2].Delete || !versions[2].Timestamp.Equal(d) {
+			t.Fatalf("expected a delete: %v", versions[2])
+		}
+		if string(versions[3].Data) != "bar3" || versions[3].Delete {
+			t.Fatalf("wrong last version: %v", versions[3])
+		}
+
+		versions, err = m.History(context.Background(), "foo", b, c)
+		if err != nil {
+			t.Fatalf("history failed: %v", err)
+		}
+		if len(versions) != 1 || string(versions[0].Data) != "bar2" {
+			t.Fatalf("wrong versions in range: %v", versions)
+		}
+	}
+
+	validate(m)
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	validate(m)
+}
+
+func TestMapPrefixAndRange(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	a := time.Now()
+	b := a.Add(time.Second)
+	m.Set(context.Background(), a, "users/42/name", []byte("bob"))
+	m.Set(context.Background(), a, "users/42/email", []byte("bob@example.com"))
+	m.Set(context.Background(), a, "users/420/name", []byte("alice"))
+	m.Set(context.Background(), a, "users/7/name", []byte("eve"))
+	m.Set(context.Background(), b, "users/42/name", []byte("robert"))
+
+	validate := func(m ReadWriteMap) {
+		kvs, err := m.GetPrefix(context.Background(), a, "users/42/")
+		if err != nil {
+			t.Fatalf("get prefix failed: %v", err)
+		}
+		if len(kvs) != 2 || kvs[0].Key != "users/42/email" || kvs[1].Key != "users/42/name" || string(kvs[1].Data) != "bob" {
+			t.Fatalf("wrong prefix results: %v", kvs)
+		}
+
+		kvs, err = m.GetPrefix(context.Background(), b, "users/42/")
+		if err != nil {
+			t.Fatalf("get prefix failed: %v", err)
+		}
+		if len(kvs) != 2 || string(kvs[1].Data) != "robert" {
+			t.Fatalf("wrong prefix results: %v", kvs)
+		}
+
+		kvs, err = m.GetRange(context.Background(), a, "users/420", "users/8")
+		if err != nil {
+			t.Fatalf("get range failed: %v", err)
+		}
+		if len(kvs) != 2 || kvs[0].Key != "users/420/name" || kvs[1].Key != "users/7/name" {
+			t.Fatalf("wrong range results: %v", kvs)
+		}
+	}
+
+	validate(m)
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	validate(m)
+}
+
+func TestMapChanges(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	a := time.Now()
+	b := a.Add(time.Second)
+	c := a.Add(time.Second * 2)
+	d := a.Add(time.Second * 3)
+
+	m.Set(context.Background(), a, "modified", []byte("v1"))
+	m.Set(context.Background(), a, "deleted", []byte("v1"))
+	m.Set(context.Background(), a, "untouched", []byte("v1"))
+	m.Set(context.Background(), b, "modified", []byte("v2"))
+	m.Set(context.Background(), b, "created", []byte("v1"))
+	m.Set(context.Background(), b, "transient", []byte("v1"))
+	m.Del(context.Background(), c, "deleted")
+	m.Del(context.Background(), c, "transient")
+	m.Set(context.Background(), c, "modified", []byte("v3"))
+	m.Set(context.Background(), d, "untouched", []byte("v2"))
+
+	validate := func(m ReadWriteMap) {
+		changes, err := m.Changes(context.Background(), a, c)
+		if err != nil {
+			t.Fatalf("changes failed: %v", err)
+		}
+		if len(changes) != 3 {
+			t.Fatalf("expected 3 changes, got %v", changes)
+		}
+		if changes[0].Key != "created" || changes[0].Type != Created || string(changes[0].After) != "v1" {
+			t.Fatalf("wrong change for created: %v", changes[0])
+		}
+		if changes[1].Key != "deleted" || changes[1].Type != Deleted || string(changes[1].Before) != "v1" {
+			t.Fatalf("wrong change for deleted: %v", changes[1])
+		}
+		if changes[2].Key != "modified" || changes[2].Type != Modified || string(changes[2].Before) != "v1" || string(changes[2].After) != "v3" {
+			t.Fatalf("wrong change for modified: %v", changes[2])
+		}
+	}
+
+	validate(m)
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	validate(m)
+}
+
+func TestMapApply(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	a := time.Now()
+	b := a.Add(time.Second)
+	m.Set(context.Background(), a, "old", []byte("value"))
+
+	err = m.Apply(context.Background(), b,
+		SetOp("foo", []byte("bar")),
+		SetOp("bar", []byte("foo")),
+		DelOp("old"),
+	)
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	err = m.Apply(context.Background(), a, SetOp("foo", []byte("past")))
+	if err == nil {
+		t.Fatalf("expected apply in the past to fail")
+	}
+
+	validate := func(m ReadWriteMap) {
+		state, err := m.GetAll(context.Background(), a)
+		if err != nil {
+			t.Fatalf("get all failed: %v", err)
+		}
+		if len(state) != 1 || string(state["old"]) != "value" {
+			t.Fatalf("wrong state before batch: %v", state)
+		}
+
+		state, err = m.GetAll(context.Background(), b)
+		if err != nil {
+			t.Fatalf("get all failed: %v", err)
+		}
+		if len(state) != 2 || string(state["foo"]) != "bar" || string(state["bar"]) != "foo" {
+			t.Fatalf("wrong state after batch: %v", state)
+		}
+	}
+
+	validate(m)
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	validate(m)
+}
+
+func TestMapSubscribe(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	a := time.Now()
+	m.Set(context.Background(), a, "users/1", []byte("old"))
+	m.Set(context.Background(), a.Add(time.Second), "users/1", []byte("bob"))
+	m.Set(context.Background(), a.Add(time.Second), "groups/1", []byte("admins"))
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	m.Set(context.Background(), a.Add(time.Second*2), "users/2", []byte("alice"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, err := m.Subscribe(ctx, "users/", a.Add(time.Second))
+	if err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	m.Del(context.Background(), a.Add(time.Second*3), "users/1")
+	m.Set(context.Background(), a.Add(time.Second*3), "groups/2", []byte("users"))
+
+	expected := []Event{
+		{Timestamp: a.Add(time.Second), Key: "users/1", Data: []byte("bob")},
+		{Timestamp: a.Add(time.Second * 2), Key: "users/2", Data: []byte("alice")},
+		{Timestamp: a.Add(time.Second * 3), Key: "users/1", Delete: true},
+	}
+	for _, want := range expected {
+		select {
+		case e := <-sub.Events():
+			if e.Key != want.Key || !e.Timestamp.Equal(want.Timestamp) || string(e.Data) != string(want.Data) || e.Delete != want.Delete {
+				t.Fatalf("expected %v got %v", want, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	sub.Close()
+	for range sub.Events() {
+	}
+	if sub.Err() != nil {
+		t.Fatalf("expected no error after close, got %v", sub.Err())
+	}
+}
+
+func TestMapSubscribeOverflow(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, SubscriberBuffer: 2})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	sub, err := m.Subscribe(context.Background(), "", time.Now())
+	if err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	// Nobody is reading, so writes must not block
+	for idx := range 10 {
+		m.Set(context.Background(), time.Now(), fmt.Sprintf("key%d", idx), []byte("value"))
+	}
+
+	for range sub.Events() {
+	}
+	if !errors.Is(sub.Err(), ErrSubscriberOverflow) {
+		t.Fatalf("expected overflow, got %v", sub.Err())
+	}
+}
+
+func TestMapSubscribeLongReplay(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, SubscriberBuffer: 4})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(context.Background())
+
+	a := time.Now()
+	for idx := range 10 {
+		m.Set(context.Background(), a.Add(time.Second*time.Duration(idx)), fmt.Sprintf("key%d", idx), []byte("value"))
+	}
+
+	// The replay is longer than the buffer, only live events count against it
+	sub, err := m.Subscribe(context.Background(), "", time.Time{})
+	if err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	m.Set(context.Background(), a.Add(time.Second*10), "key10", []byte("value"))
+
+	for idx := range 11 {
+		select {
+		case e := <-sub.Events():
+			if e.Key != fmt.Sprintf("key%d", idx) {
+				t.Fatalf("expected key%d, got %s", idx, e.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected event %d, subscription ended with %v", idx, sub.Err())
+		}
+	}
+	sub.Close()
+	if sub.Err() != nil {
+		t.Fatalf("expected no error, got %v", sub.Err())
+	}
+}
+
+func TestMapFlushAndClose(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, FlushOnClose: true})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	a := time.Now()
+	m.Set(context.Background(), a, "foo", []byte("bar"))
+	m.Set(context.Background(), a.Add(time.Second), "bar", []byte("foo"))
+
+	err = m.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	keys, _ := s.GetKeysWithPrefix(context.Background(), "events/")
+	if len(keys) != 0 {
+		t.Fatalf("expected flush to chunk every event file, found %v", keys)
+	}
+	chunkKeys, _ := s.GetKeysWithPrefix(context.Background(), "")
+	if len(chunkKeys) == 0 {
+		t.Fatalf("expected a chunk to be written")
+	}
+
+	m.Set(context.Background(), a.Add(time.Second*2), "baz", []byte("qux"))
+
+	sub, err := m.Subscribe(context.Background(), "", a.Add(time.Second*3))
+	if err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	err = m.Close(context.Background())
+	if err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	for range sub.Events() {
+	}
+	if !errors.Is(sub.Err(), ErrMapClosed) {
+		t.Fatalf("expected subscription to end with ErrMapClosed, got %v", sub.Err())
+	}
+
+	if err := m.Set(context.Background(), time.Now(), "foo", []byte("bar")); !errors.Is(err, ErrMapClosed) {
+		t.Fatalf("expected ErrMapClosed from Set, got %v", err)
+	}
+	if _, err := m.Get(context.Background(), time.Now(), "foo"); !errors.Is(err, ErrMapClosed) {
+		t.Fatalf("expected ErrMapClosed from Get, got %v", err)
+	}
+	if err := m.Close(context.Background()); !errors.Is(err, ErrMapClosed) {
+		t.Fatalf("expected ErrMapClosed from Close, got %v", err)
+	}
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	state, err := m.GetAll(context.Background(), a.Add(time.Second))
+	if err != nil {
+		t.Fatalf("get all failed: %v", err)
+	}
+	if len(state) != 2 || string(state["foo"]) != "bar" {
+		t.Fatalf("wrong state after reopening: %v", state)
+	}
+	state, err = m.GetAll(context.Background(), a.Add(time.Second*2))
+	if err != nil {
+		t.Fatalf("get all failed: %v", err)
+	}
+	if len(state) != 3 || string(state["foo"]) != "bar" || string(state["baz"]) != "qux" {
+		t.Fatalf("wrong state after reopening: %v", state)
+	}
+}
+
+func TestMapStateAcrossChunks(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now()
+
+	// Each flush ends a chunk, keys are only written in the first one
+	m.Set(ctx, a, "foo", []byte("bar"))
+	m.Set(ctx, a, "gone", []byte("soon"))
+	m.Flush(ctx)
+	m.Set(ctx, a.Add(time.Second), "baz", []byte("qux"))
+	m.Del(ctx, a.Add(time.Second), "gone")
+	m.Flush(ctx)
+	m.Set(ctx, a.Add(time.Second*2), "baz", []byte("quux"))
+	m.Flush(ctx)
+
+	// Written since opening the map, but foo only lives in the first chunk
+	value, err := m.Get(ctx, a.Add(time.Second*2), "foo")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if string(value) != "bar" {
+		t.Fatalf("wrong value: %s", value)
+	}
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	expected := []map[string]string{
+		{"foo": "bar", "gone": "soon"},
+		{"foo": "bar", "baz": "qux"},
+		{"foo": "bar", "baz": "quux"},
+	}
+	for idx, want := range expected {
+		state, err := m.GetAll(ctx, a.Add(time.Second*time.Duration(idx)))
+		if err != nil {
+			t.Fatalf("get all failed: %v", err)
+		}
+		if len(state) != len(want) {
+			t.Fatalf("wrong state at %d: %v", idx, state)
+		}
+		for k, v := range want {
+			if string(state[k]) != v {
+				t.Fatalf("wrong state at %d: %v", idx, state)
+			}
+		}
+	}
+
+	// Carrying foo over doesn't make it look like it was written again
+	history, err := m.History(ctx, "foo", a.Add(time.Second), a.Add(time.Second*2))
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if len(history) != 0 {
+		t.Fatalf("wrong history: %v", history)
+	}
+	changes, err := m.Changes(ctx, a, a.Add(time.Second*2))
+	if err != nil {
+		t.Fatalf("changes failed: %v", err)
+	}
+	if len(changes) != 2 || changes[0].Key != "baz" || changes[1].Key != "gone" || changes[1].Type != Deleted {
+		t.Fatalf("wrong changes: %v", changes)
+	}
+}
+
+func TestMapContextCancelled(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	a := time.Now()
+	m.Set(context.Background(), a, "foo", []byte("bar"))
+	m.Set(context.Background(), a.Add(time.Second), "foo", []byte("baz"))
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := m.Get(ctx, a, "foo"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected get to be cancelled, got %v", err)
+	}
+	if _, err := m.History(ctx, "foo", a, a.Add(time.Second)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected history to be cancelled, got %v", err)
+	}
+	if err := m.Set(ctx, a.Add(time.Second*2), "foo", []byte("qux")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected set to be cancelled, got %v", err)
+	}
+
+	// Nothing was written by the cancelled set
+	value, err := m.Get(context.Background(), a.Add(time.Second*2), "foo")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if string(value) != "baz" {
+		t.Fatalf("wrong value: %s", value)
+	}
+}
+
+func TestMapSnapshot(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	a := time.Now()
+	m.Set(context.Background(), a, "user/1", []byte("alice"))
+	m.Set(context.Background(), a, "user/2", []byte("bob"))
+	m.Set(context.Background(), a.Add(time.Second), "user/1", []byte("alicia"))
+
+	snap, err := m.Snapshot(context.Background(), a)
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	latest, err := m.Snapshot(context.Background(), time.Time{})
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if !latest.Timestamp().Equal(a.Add(time.Second)) {
+		t.Fatalf("wrong snapshot timestamp: %v", latest.Timestamp())
+	}
+
+	// Writers keep going, the snapshots don't move
+	m.Set(context.Background(), a.Add(time.Second*2), "user/1", []byte("al"))
+	m.Del(context.Background(), a.Add(time.Second*2), "user/2")
+	m.Set(context.Background(), a.Add(time.Second*2), "user/3", []byte("carol"))
+
+	value, err := snap.Get(context.Background(), "user/1")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if string(value) != "alice" {
+		t.Fatalf("wrong value: %s", value)
+	}
+
+	kvs, err := latest.GetPrefix(context.Background(), "user/")
+	if err != nil {
+		t.Fatalf("get prefix failed: %v", err)
+	}
+	if len(kvs) != 2 || string(kvs[0].Data) != "alicia" || string(kvs[1].Data) != "bob" {
+		t.Fatalf("wrong prefix: %v", kvs)
+	}
+
+	all, err := snap.GetAll(context.Background())
+	if err != nil {
+		t.Fatalf("get all failed: %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("wrong state: %v", all)
+	}
+
+	snap.Close()
+	if _, err := snap.Get(context.Background(), "user/1"); !errors.Is(err, ErrSnapshotClosed) {
+		t.Fatalf("expected closed snapshot, got %v", err)
+	}
+	latest.Close()
+}
+
+func TestMapConditionalWrites(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now()
+
+	// A nil expected value means the key must not exist yet
+	if err := m.SetIf(ctx, a, "config", nil, []byte("v1")); err != nil {
+		t.Fatalf("set if failed: %v", err)
+	}
+	err = m.SetIf(ctx, a, "config", nil, []byte("v1"))
+	var conflict *ConflictError
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if string(conflict.Current.Data) != "v1" || !conflict.Current.Timestamp.Equal(a) {
+		t.Fatalf("wrong conflict: %+v", conflict.Current)
+	}
+
+	if err := m.SetIf(ctx, a.Add(time.Second), "config", []byte("v0"), []byte("v2")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if err := m.SetIf(ctx, a.Add(time.Second), "config", []byte("v1"), []byte("v2")); err != nil {
+		t.Fatalf("set if failed: %v", err)
+	}
+
+	version, err := m.GetVersion(ctx, "config")
+	if err != nil {
+		t.Fatalf("get version failed: %v", err)
+	}
+	if !version.Timestamp.Equal(a.Add(time.Second)) || string(version.Data) != "v2" {
+		t.Fatalf("wrong version: %+v", version)
+	}
+
+	if err := m.SetIfVersion(ctx, a.Add(time.Second*2), "config", a, []byte("v3")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if err := m.SetIfVersion(ctx, a.Add(time.Second*2), "config", version.Timestamp, []byte("v3")); err != nil {
+		t.Fatalf("set if version failed: %v", err)
+	}
+
+	// Versions survive a reopen
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	version, err = m.GetVersion(ctx, "config")
+	if err != nil {
+		t.Fatalf("get version failed: %v", err)
+	}
+	if !version.Timestamp.Equal(a.Add(time.Second*2)) || string(version.Data) != "v3" {
+		t.Fatalf("wrong version after reopen: %+v", version)
+	}
+
+	if err := m.DelIf(ctx, a.Add(time.Second*3), "config", []byte("v2")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if err := m.DelIfVersion(ctx, a.Add(time.Second*3), "config", version.Timestamp); err != nil {
+		t.Fatalf("del if version failed: %v", err)
+	}
+
+	version, err = m.GetVersion(ctx, "config")
+	if err != nil {
+		t.Fatalf("get version failed: %v", err)
+	}
+	if !version.Delete || !version.Timestamp.Equal(a.Add(time.Second*3)) {
+		t.Fatalf("wrong version after delete: %+v", version)
+	}
+
+	version, err = m.GetVersion(ctx, "missing")
+	if err != nil {
+		t.Fatalf("get version failed: %v", err)
+	}
+	if !version.Timestamp.IsZero() || version.Delete {
+		t.Fatalf("wrong version for missing key: %+v", version)
+	}
+}
+
+func TestMapVersionFromChunks(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now()
+	m.Set(ctx, a, "config", []byte("v1"))
+	m.Flush(ctx)
+	for idx := 1; idx < 5; idx++ {
+		m.Set(ctx, a.Add(time.Second*time.Duration(idx)), fmt.Sprintf("key%d", idx), []byte("value"))
+		m.Flush(ctx)
+	}
+	m.Close(ctx)
+
+	// Only the chunks newer than the last write are looked at
+	metrics := &countingMetrics{}
+	m, err = NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, Metrics: metrics})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	misses := metrics.count("chunk_cache_misses")
+	version, err := m.GetVersion(ctx, "key4")
+	if err != nil || !version.Timestamp.Equal(a.Add(time.Second*4)) {
+		t.Fatalf("wrong version: %+v %v", version, err)
+	}
+	if metrics.count("chunk_cache_misses") != misses {
+		t.Fatalf("expected no chunks to be loaded, have %v", metrics)
+	}
+	m.Close(ctx)
+
+	// The chunk with the write is gone, the version is carried in the keyframes after it
+	m, err = NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, Retention: RetentionPolicy{MaxChunks: 2}})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(ctx)
+	report, err := m.Retain(ctx, false)
+	if err != nil || len(report.Removed) != 3 {
+		t.Fatalf("expected 3 chunks removed, have %+v %v", report, err)
+	}
+	version, err = m.GetVersion(ctx, "config")
+	if err != nil || !version.Timestamp.Equal(a) || string(version.Data) != "v1" {
+		t.Fatalf("wrong version after retention: %+v %v", version, err)
+	}
+	if err := m.SetIfVersion(ctx, a.Add(time.Second*5), "config", time.Time{}, []byte("v2")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+}
+
+func TestMapTTL(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now().Add(time.Hour)
+
+	m.SetWithTTL(ctx, a, "session", []byte("token"), time.Second*2)
+	m.SetWithTTL(ctx, a, "renewed", []byte("token"), time.Second*2)
+	m.Set(ctx, a.Add(time.Second), "renewed", []byte("token2"))
+
+	value, err := m.Get(ctx, a.Add(time.Second), "session")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if string(value) != "token" {
+		t.Fatalf("wrong value: %s", value)
+	}
+
+	// Reads past the expiry don't see the key even before the delete is written
+	value, err = m.Get(ctx, a.Add(time.Second*3), "session")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if value != nil {
+		t.Fatalf("expected session to have expired: %s", value)
+	}
+
+	// A later write writes the delete at the time the key expired
+	m.Set(ctx, a.Add(time.Second*5), "other", []byte("x"))
+	history, err := m.History(ctx, "session", a, a.Add(time.Second*5))
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if len(history) != 2 || !history[1].Delete || !history[1].Timestamp.Equal(a.Add(time.Second*2)) {
+		t.Fatalf("wrong history: %v", history)
+	}
+
+	value, err = m.Get(ctx, a.Add(time.Second*5), "renewed")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if string(value) != "token2" {
+		t.Fatalf("renewed key should not expire: %s", value)
+	}
+}
+
+func TestMapTTLRecovery(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, FlushOnClose: true})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now()
+	ttl := time.Millisecond * 300
+
+	m.SetWithTTL(ctx, a, "session", []byte("token"), ttl)
+	if err := m.Close(ctx); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// The key expires while the map is closed
+	time.Sleep(ttl + time.Millisecond*100)
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	history, err := m.History(ctx, "session", a, time.Now())
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if len(history) != 2 || !history[1].Delete || !history[1].Timestamp.Equal(a.Add(ttl)) {
+		t.Fatalf("wrong history: %v", history)
+	}
+
+	value, err := m.Get(ctx, time.Now(), "session")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if value != nil {
+		t.Fatalf("expected session to have expired: %s", value)
+	}
+}
+
+func TestMapManifest(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now()
+	for idx := range 3 {
+		m.Set(ctx, a.Add(time.Second*time.Duration(idx)), fmt.Sprintf("key%d", idx), []byte("value"))
+		m.Flush(ctx)
+	}
+
+	check := func() {
+		m, err := NewMap(s)
+		if err != nil {
+			t.Fatalf("could not create map: %v", err)
+		}
+		state, err := m.GetAll(ctx, a.Add(time.Second*2))
+		if err != nil {
+			t.Fatalf("get all failed: %v", err)
+		}
+		if len(state) != 3 {
+			t.Fatalf("wrong state: %v", state)
+		}
+	}
+
+	// The headers are loaded from the manifest without walking the chain
+	if _, err := s.Read(ctx, "manifest.idx"); err != nil {
+		t.Fatalf("expected a manifest: %v", err)
+	}
+	start, _ := s.Read(ctx, "start.idx")
+	s.Delete(ctx, "start.idx")
+	check()
+
+	// Without a manifest the chain is walked and the manifest is written again
+	s.Write(ctx, "start.idx", start)
+	s.Delete(ctx, "manifest.idx")
+	check()
+	if _, err := s.Read(ctx, "manifest.idx"); err != nil {
+		t.Fatalf("expected the manifest to be rebuilt: %v", err)
+	}
+}
+
+func TestMapCompact(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now()
+	for idx := range 6 {
+		timestamp := a.Add(time.Second * time.Duration(idx))
+		m.Set(ctx, timestamp, fmt.Sprintf("key%d", idx%3), []byte(fmt.Sprintf("value%d", idx)))
+		if idx == 4 {
+			m.Del(ctx, timestamp, "key0")
+		}
+		m.Flush(ctx)
+	}
+
+	snapshot := func(m ReadWriteMap) ([]map[string][]byte, []Version) {
+		states := []map[string][]byte{}
+		for idx := range 6 {
+			state, err := m.GetAll(ctx, a.Add(time.Second*time.Duration(idx)))
+			if err != nil {
+				t.Fatalf("get all failed: %v", err)
+			}
+			states = append(states, state)
+		}
+		history, err := m.History(ctx, "key0", a, a.Add(time.Second*5))
+		if err != nil {
+			t.Fatalf("history failed: %v", err)
+		}
+		return states, history
+	}
+	compare := func(m ReadWriteMap, states []map[string][]byte, history []Version) {
+		after, afterHistory := snapshot(m)
+		if fmt.Sprint(after) != fmt.Sprint(states) {
+			t.Fatalf("state changed by compaction: %v != %v", after, states)
+		}
+		if fmt.Sprint(afterHistory) != fmt.Sprint(history) {
+			t.Fatalf("history changed by compaction: %v != %v", afterHistory, history)
+		}
+	}
+
+	states, history := snapshot(m)
+
+	before, _ := s.GetKeysWithPrefix(ctx, "")
+	err = m.Compact(ctx)
+	if err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	compare(m, states, history)
+
+	headers := 0
+	after, _ := s.GetKeysWithPrefix(ctx, "")
+	for _, key := range after {
+		if strings.HasSuffix(key, ".header") {
+			headers++
+		}
+	}
+	if headers != 1 || len(after) >= len(before) {
+		t.Fatalf("expected the chunks to be merged into one, have %v", after)
+	}
+
+	// Both the manifest and the linked headers find the merged chunk
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	compare(m, states, history)
+
+	s.Delete(ctx, "manifest.idx")
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	compare(m, states, history)
+}
+
+func TestMapDownsample(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMapWithConfig(s, MapConfig{
+		MaxChunkTargetSize: 8 * 1024 * 1024,
+		Downsample:         []DownsamplePolicy{{Age: time.Hour, Bucket: time.Minute}},
+	})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now().Truncate(time.Hour).Add(time.Hour)
+
+	// Six writes a minute for five minutes, two hours before the newest data
+	for idx := range 30 {
+		m.Set(ctx, a.Add(time.Second*10*time.Duration(idx)), "key", []byte(fmt.Sprintf("value%d", idx)))
+	}
+	m.Flush(ctx)
+	m.Set(ctx, a.Add(time.Hour*2), "other", []byte("value"))
+	m.Flush(ctx)
+
+	chunkBytes := func() int {
+		total := 0
+		keys, _ := s.GetKeysWithPrefix(ctx, "")
+		for _, key := range keys {
+			if strings.HasSuffix(key, ".chunk") {
+				b, _ := s.Read(ctx, key)
+				total += len(b)
+			}
+		}
+		return total
+	}
+	before := chunkBytes()
+
+	err = m.Downsample(ctx)
+	if err != nil {
+		t.Fatalf("downsample failed: %v", err)
+	}
+	if after := chunkBytes(); after >= before {
+		t.Fatalf("expected storage to shrink: %d >= %d", after, before)
+	}
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	history, err := m.History(ctx, "key", a, a.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if len(history) != 5 {
+		t.Fatalf("expected one version per minute: %v", history)
+	}
+	for idx, v := range history {
+		if !v.Timestamp.Equal(a.Add(time.Minute*time.Duration(idx))) || string(v.Data) != fmt.Sprintf("value%d", idx*6+5) {
+			t.Fatalf("wrong version %d: %v", idx, v)
+		}
+	}
+
+	// Anywhere in the bucket reads the last value written in it
+	value, err := m.Get(ctx, a.Add(time.Second*15), "key")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if string(value) != "value5" {
+		t.Fatalf("wrong value: %s", value)
+	}
+	value, err = m.Get(ctx, a.Add(time.Hour*2), "key")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if string(value) != "value29" {
+		t.Fatalf("wrong value: %s", value)
+	}
+}
+
+func TestMapRetention(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now()
+	for idx := range 5 {
+		timestamp := a.Add(time.Second * time.Duration(idx))
+		m.Set(ctx, timestamp, "key", []byte(fmt.Sprintf("value%d", idx)))
+		m.Set(ctx, timestamp, "tmp/key", []byte(fmt.Sprintf("tmp%d", idx)))
+		m.Flush(ctx)
+	}
+	m.Close(ctx)
+
+	countHeaders := func(s storage.System) int {
+		keys, _ := s.GetKeysWithPrefix(ctx, "")
+		headers := 0
+		for _, key := range keys {
+			if strings.HasSuffix(key, ".header") {
+				headers++
+			}
+		}
+		return headers
+	}
+	if countHeaders(s) != 5 {
+		t.Fatalf("expected 5 chunks, have %d", countHeaders(s))
+	}
+
+	archive := storage.NewMemoryStorage()
+	m, err = NewMapWithConfig(s, MapConfig{
+		MaxChunkTargetSize: 8 * 1024 * 1024,
+		Retention: RetentionPolicy{
+			MaxChunks: 3,
+			Prefixes:  []PrefixRetention{{Prefix: "tmp/"}},
+		},
+		Archive: archive,
+	})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	report, err := m.Retain(ctx, true)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if len(report.Removed) != 2 || len(report.Rewritten) != 2 || report.Bytes <= 0 {
+		t.Fatalf("unexpected dry run report: %+v", report)
+	}
+	if countHeaders(s) != 5 || countHeaders(archive) != 0 {
+		t.Fatalf("dry run changed storage")
+	}
+
+	report, err = m.Retain(ctx, false)
+	if err != nil {
+		t.Fatalf("retain failed: %v", err)
+	}
+	if len(report.Removed) != 2 || len(report.Rewritten) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if countHeaders(s) != 3 || countHeaders(archive) != 4 {
+		t.Fatalf("expected 3 chunks kept and 4 archived, have %d and %d", countHeaders(s), countHeaders(archive))
+	}
+
+	// Nothing is left to do
+	report, err = m.Retain(ctx, true)
+	if err != nil || len(report.Removed) != 0 || len(report.Rewritten) != 0 {
+		t.Fatalf("expected nothing left to retain: %+v %v", report, err)
+	}
+	m.Close(ctx)
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	for idx := 2; idx < 5; idx++ {
+		state, err := m.GetAll(ctx, a.Add(time.Second*time.Duration(idx)))
+		if err != nil {
+			t.Fatalf("get all failed: %v", err)
+		}
+		if string(state["key"]) != fmt.Sprintf("value%d", idx) {
+			t.Fatalf("expected value%d, have %v", idx, state)
+		}
+		_, ok := state["tmp/key"]
+		if idx < 4 && ok {
+			t.Fatalf("expected tmp/key to be dropped at %d, have %v", idx, state)
+		}
+		if idx == 4 && string(state["tmp/key"]) != "tmp4" {
+			t.Fatalf("expected tmp/key in the newest chunk, have %v", state)
+		}
+	}
+	if m.GetMinTime().Before(a.Add(time.Second * 2)) {
+		t.Fatalf("expected the oldest chunks to be gone, min time is %v", m.GetMinTime())
+	}
+}
+
+// readBlockingStorage holds up reads of key until release is closed
+type readBlockingStorage struct {
+	storage.System
+	key     atomic.Value
+	reached chan struct{}
+	release chan struct{}
+}
+
+func (s *readBlockingStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	if key == s.key.Load() {
+		close(s.reached)
+		<-s.release
+	}
+	return s.System.Read(ctx, key)
+}
+
+func TestMapRetentionWhileWriting(t *testing.T) {
+	ctx := context.Background()
+	s := &readBlockingStorage{System: storage.NewMemoryStorage(), reached: make(chan struct{}), release: make(chan struct{})}
+	s.key.Store("")
+	m, err := NewMapWithConfig(s, MapConfig{
+		MaxChunkTargetSize: 8 * 1024 * 1024,
+		FlushPolicy:        FlushOnCount{Events: 2},
+		Retention:          RetentionPolicy{Prefixes: []PrefixRetention{{Prefix: "tmp/", MaxAge: 10 * time.Second}}},
+	})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(ctx)
+	defer close(s.release)
+
+	a := time.Now().Truncate(time.Minute).Add(time.Hour)
+	m.Set(ctx, a, "tmp/key", []byte("tmp"))
+	m.Set(ctx, a.Add(time.Second), "key", []byte("value"))
+	m.Flush(ctx)
+	m.Get(ctx, a, "key") // The chunk is cached, only retention reads it from storage
+	keys, _ := s.GetKeysWithPrefix(ctx, "")
+	for _, key := range keys {
+		if strings.HasSuffix(key, ".chunk") {
+			s.key.Store(key)
+		}
+	}
+
+	// The next chunk has the first one rewritten without tmp/, which is held up
+	for idx := range 3 {
+		m.Set(ctx, a.Add(time.Second*time.Duration(20+idx)), "key", []byte(fmt.Sprint(idx)))
+	}
+	<-s.reached
+
+	written := make(chan error)
+	go func() {
+		written <- m.Set(ctx, a.Add(time.Second*30), "key", []byte("written"))
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected writes to carry on while a chunk is rewritten")
+	}
+}
+
+func TestMapCorruption(t *testing.T) {
+	ctx := context.Background()
+
+	for _, mode := range []CorruptionMode{FailOnCorrupt, UnreadableOnCorrupt, RebuildCorrupt} {
+		s := storage.NewMemoryStorage()
+		config := MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, OnCorrupt: mode}
+		m, err := NewMapWithConfig(s, config)
+		if err != nil {
+			t.Fatalf("could not create map: %v", err)
+		}
+		a := time.Now()
+		for idx := range 3 {
+			m.Set(ctx, a.Add(time.Second*time.Duration(idx)), "key", []byte(fmt.Sprintf("value%d", idx)))
+			m.Flush(ctx)
+		}
+		m.Close(ctx)
+
+		// Flip a bit in the middle chunk
+		keys, _ := s.GetKeysWithPrefix(ctx, "")
+		chunkKeys := []string{}
+		for _, key := range keys {
+			if strings.HasSuffix(key, ".chunk") {
+				chunkKeys = append(chunkKeys, key)
+			}
+		}
+		sort.Strings(chunkKeys)
+		if len(chunkKeys) != 3 {
+			t.Fatalf("expected 3 chunks, have %v", chunkKeys)
+		}
+		good, _ := s.Read(ctx, chunkKeys[1])
+		bad := append([]byte{}, good...)
+		bad[len(bad)-1] ^= 0xff
+		s.Write(ctx, chunkKeys[1], bad)
+
+		m, err = NewMapWithConfig(s, config)
+		if err != nil {
+			t.Fatalf("could not create map: %v", err)
+		}
+		state, err := m.GetAll(ctx, a.Add(time.Second))
+		if mode == RebuildCorrupt {
+			if err != nil || string(state["key"]) != "value1" {
+				t.Fatalf("expected the chunk to be rebuilt: %v %v", state, err)
+			}
+			rebuilt, _ := s.Read(ctx, chunkKeys[1])
+			if bytes.Equal(rebuilt, bad) {
+				t.Fatalf("expected the rebuilt chunk to be saved")
+			}
+			m.Close(ctx)
+			continue
+		}
+
+		var corrupt *CorruptError
+		if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) || string(corrupt.Id)+".chunk" != chunkKeys[1] {
+			t.Fatalf("expected a corrupt error for %s, got %v", chunkKeys[1], err)
+		}
+
+		// Reads outside the chunk still work
+		state, err = m.GetAll(ctx, a.Add(time.Second*2))
+		if err != nil || string(state["key"]) != "value2" {
+			t.Fatalf("expected the newest chunk to be readable: %v %v", state, err)
+		}
+
+		// Failures aren't cached, but a range marked unreadable stays that way
+		s.Write(ctx, chunkKeys[1], good)
+		_, err = m.GetAll(ctx, a.Add(time.Second))
+		if mode == FailOnCorrupt && err != nil {
+			t.Fatalf("expected the repaired chunk to be read: %v", err)
+		}
+		if mode == UnreadableOnCorrupt && !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("expected the chunk to stay unreadable: %v", err)
+		}
+		m.Close(ctx)
+	}
+}
+
+func TestMapRetainedEventsReleased(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, OnCorrupt: RebuildCorrupt})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	a := time.Now()
+	for idx := range 4 {
+		m.Set(ctx, a.Add(time.Second*time.Duration(idx)), "key", []byte(fmt.Sprintf("value%d", idx)))
+		m.Flush(ctx)
+	}
+	m.Close(ctx)
+
+	retained := func() int {
+		keys, _ := s.GetKeysWithPrefix(ctx, "retained/")
+		return len(keys)
+	}
+	if retained() != 4 {
+		t.Fatalf("expected an event log per chunk, have %d", retained())
+	}
+
+	m, err = NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, OnCorrupt: RebuildCorrupt, Retention: RetentionPolicy{MaxChunks: 2}})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(ctx)
+	if _, err := m.Retain(ctx, false); err != nil {
+		t.Fatalf("retain failed: %v", err)
+	}
+	if retained() != 2 {
+		t.Fatalf("expected the event logs of removed chunks to be deleted, have %d", retained())
+	}
+
+	// What is left can still be rebuilt
+	kept, err := events.RetainedEvents(ctx, s, a.Add(time.Second*2), a.Add(time.Second*2))
+	if err != nil || len(kept) != 1 || string(kept[0].Data) != "value2" {
+		t.Fatalf("expected the event of the kept chunk, have %v %v", kept, err)
+	}
+}
+
+func TestMapRebuildKeepsRetention(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	config := MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, OnCorrupt: RebuildCorrupt}
+	m, err := NewMapWithConfig(s, config)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	a := time.Now()
+	for idx := range 3 {
+		timestamp := a.Add(time.Second * time.Duration(idx))
+		m.Set(ctx, timestamp, "key", []byte(fmt.Sprintf("value%d", idx)))
+		m.Set(ctx, timestamp, "tmp/key", []byte(fmt.Sprintf("tmp%d", idx)))
+		m.Flush(ctx)
+	}
+	m.Close(ctx)
+
+	config.Retention = RetentionPolicy{Prefixes: []PrefixRetention{{Prefix: "tmp/"}}}
+	m, err = NewMapWithConfig(s, config)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	if _, err := m.Retain(ctx, false); err != nil {
+		t.Fatalf("retain failed: %v", err)
+	}
+	m.Close(ctx)
+
+	// Flip a bit in every chunk so they are all rebuilt from the event logs
+	keys, _ := s.GetKeysWithPrefix(ctx, "")
+	for _, key := range keys {
+		if strings.HasSuffix(key, ".chunk") {
+			b, _ := s.Read(ctx, key)
+			b[len(b)-1] ^= 0xff
+			s.Write(ctx, key, b)
+		}
+	}
+
+	m, err = NewMapWithConfig(s, config)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(ctx)
+	for idx := range 3 {
+		state, err := m.GetAll(ctx, a.Add(time.Second*time.Duration(idx)))
+		if err != nil || string(state["key"]) != fmt.Sprintf("value%d", idx) {
+			t.Fatalf("expected the chunk to be rebuilt: %v %v", state, err)
+		}
+		_, ok := state["tmp/key"]
+		if idx < 2 && ok {
+			t.Fatalf("expected tmp/key to stay dropped at %d, have %v", idx, state)
+		}
+		if idx == 2 && string(state["tmp/key"]) != "tmp2" {
+			t.Fatalf("expected tmp/key in the newest chunk, have %v", state)
+		}
+	}
+}
+
+func TestMapChunkCache(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now()
+	value := strings.Repeat("x", 1000)
+	for idx := range 4 {
+		m.Set(ctx, a.Add(time.Second*time.Duration(idx)), "key", []byte(value+fmt.Sprint(idx)))
+		m.Flush(ctx)
+	}
+	m.Close(ctx)
+
+	// Room for about two chunks
+	metrics := &countingMetrics{}
+	m, err = NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, Metrics: metrics, ChunkCacheBytes: 2500})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	read := func(idx int) {
+		v, err := m.Get(ctx, a.Add(time.Second*time.Duration(idx)), "key")
+		if err != nil || string(v) != value+fmt.Sprint(idx) {
+			t.Fatalf("expected value%d, have %q %v", idx, v, err)
+		}
+	}
+
+	// Opening the map loaded the newest chunk
+	misses, hits := metrics.count("chunk_cache_misses"), metrics.count("chunk_cache_hits")
+	for range 8 {
+		read(0)
+	}
+	if metrics.count("chunk_cache_misses") != misses+1 || metrics.count("chunk_cache_hits") != hits+7 {
+		t.Fatalf("expected a single load, have %v", metrics)
+	}
+
+	for idx := range 4 {
+		read(idx)
+	}
+	if metrics.count("chunk_cache_evictions") == 0 {
+		t.Fatalf("expected chunks to be evicted, have %v", metrics)
+	}
+	misses = metrics.count("chunk_cache_misses")
+	read(3)
+	if metrics.count("chunk_cache_misses") != misses {
+		t.Fatalf("expected the last chunk read to be cached, have %v", metrics)
+	}
+	read(0)
+	if metrics.count("chunk_cache_misses") != misses+1 {
+		t.Fatalf("expected the least recently used chunk to be evicted, have %v", metrics)
+	}
+}
+
+func TestMapTornEventLog(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	m, err := NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	ctx := context.Background()
+	a := time.Now()
+	m.Set(ctx, a, "foo", []byte("bar"))
+	m.Apply(ctx, a.Add(time.Second), SetOp("foo", []byte("baz")), SetOp("qux", []byte("quux")))
+	m.Set(ctx, a.Add(time.Second*2), "foo", []byte("torn"))
+	m.Close(ctx)
+
+	var key string
+	var data []byte
+	keys, _ := s.GetKeysWithPrefix(ctx, "events/")
+	for _, k := range keys {
+		if b, _ := s.Read(ctx, k); len(b) > 0 {
+			key, data = k, b
+		}
+	}
+	if key == "" {
+		t.Fatalf("expected an event log, have %v", keys)
+	}
+
+	// A crash part way through the last record
+	s.Write(ctx, key, data[:len(data)-3])
+	_, err = NewMap(s)
+	if err == nil {
+		t.Fatalf("expected a torn event log to fail without recovery")
+	}
+
+	// A flipped bit is caught by the record's checksum
+	bad := append([]byte{}, data...)
+	bad[len(bad)-1] ^= 0xff
+	s.Write(ctx, key, bad)
+	_, err = NewMap(s)
+	if err == nil {
+		t.Fatalf("expected a corrupt event log to fail without recovery")
+	}
+
+	m, err = NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, RecoverEventLogs: true})
+	if err != nil {
+		t.Fatalf("could not recover map: %v", err)
+	}
+	state, err := m.GetAll(ctx, a.Add(time.Second*2))
+	if err != nil {
+		t.Fatalf("get all failed: %v", err)
+	}
+	if string(state["foo"]) != "baz" || string(state["qux"]) != "quux" {
+		t.Fatalf("expected the records before the torn one, have %v", state)
+	}
+}
+
+// syncCountingStorage counts how often its streams are synced
+type syncCountingStorage struct {
+	storage.System
+	syncs atomic.Int64
+}
+
+type syncCountingWriter struct {
+	storage.StreamWriter
+	s *syncCountingStorage
+}
+
+func (w syncCountingWriter) Sync() error {
+	w.s.syncs.Add(1)
+	return storage.Sync(w.StreamWriter)
+}
+
+func (s *syncCountingStorage) BeginStream(ctx context.Context, key string) storage.StreamWriter {
+	return syncCountingWriter{StreamWriter: s.System.BeginStream(ctx, key), s: s}
+}
+
+func TestMapDurability(t *testing.T) {
+	ctx := context.Background()
+
+	for _, durability := range []Durability{
+		{Mode: SyncNone},
+		{Mode: SyncEveryWrite},
+		{Mode: SyncGroup, Bytes: 1 << 20, Interval: 200 * time.Millisecond},
+		{Mode: SyncGroup, Bytes: 1},
+	} {
+		s := &syncCountingStorage{System: storage.NewDiskStorage(t.TempDir())}
+		m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, Durability: durability})
+		if err != nil {
+			t.Fatalf("could not create map: %v", err)
+		}
+
+		a := time.Now()
+		for idx := range 5 {
+			err := m.Set(ctx, a.Add(time.Millisecond*time.Duration(idx)), "key", []byte(fmt.Sprint(idx)))
+			if err != nil {
+				t.Fatalf("set failed: %v", err)
+			}
+		}
+
+		syncs := s.syncs.Load()
+		switch {
+		case durability.Mode == SyncNone && syncs != 0:
+			t.Fatalf("expected no syncs, have %d", syncs)
+		case durability.Mode == SyncEveryWrite && syncs != 5:
+			t.Fatalf("expected a sync per write, have %d", syncs)
+		case durability.Mode == SyncGroup && durability.Bytes == 1 && syncs != 5:
+			t.Fatalf("expected a sync per write once the group is full, have %d", syncs)
+		case durability.Mode == SyncGroup && durability.Bytes > 1:
+			if syncs >= 5 {
+				t.Fatalf("expected writes to wait for the group, have %d syncs", syncs)
+			}
+			time.Sleep(400 * time.Millisecond)
+			if s.syncs.Load() != syncs+1 {
+				t.Fatalf("expected the group to be synced once, have %d", s.syncs.Load()-syncs)
+			}
+		}
+		m.Close(ctx)
+
+		m, err = NewMap(s)
+		if err != nil {
+			t.Fatalf("could not create map: %v", err)
+		}
+		value, err := m.Get(ctx, a.Add(time.Millisecond*4), "key")
+		if err != nil || string(value) != "4" {
+			t.Fatalf("expected the last write, have %q %v", value, err)
+		}
+		m.Close(ctx)
+	}
+}
+
+// noSyncStorage is storage whose streams are only durable once closed, like S3
+type noSyncStorage struct {
+	storage.System
+}
+
+func (s noSyncStorage) CanSync() bool {
+	return false
+}
+
+func TestMapDurabilityUnsupported(t *testing.T) {
+	s := noSyncStorage{System: storage.NewMemoryStorage()}
+	for _, mode := range []DurabilityMode{SyncEveryWrite, SyncGroup} {
+		_, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, Durability: Durability{Mode: mode}})
+		if !errors.Is(err, storage.ErrSyncUnsupported) {
+			t.Fatalf("expected mode %v to be rejected, have %v", mode, err)
+		}
+	}
+
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	m.Close(context.Background())
+}
+
+// unregisteredCodec is a diff codec nothing could read back
+type unregisteredCodec struct{ chunks.DiffCodec }
+
+func (unregisteredCodec) Id() byte { return 200 }
+
+func TestMapDiffCodecUnregistered(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	_, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, DiffCodec: unregisteredCodec{chunks.RawCodec}})
+	if err == nil {
+		t.Fatalf("expected an unregistered diff codec to be rejected")
+	}
+
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, DiffCodec: chunks.DeltaCodec})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	m.Close(context.Background())
+}
+
+// taggedStorage can't be used as a map key
+type taggedStorage struct {
+	storage.System
+	tags []string
+}
+
+func TestMapUnhashableStorage(t *testing.T) {
+	ctx := context.Background()
+	s := taggedStorage{System: storage.NewMemoryStorage(), tags: []string{"a"}}
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 1})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	a := time.Now()
+	for idx := range 3 {
+		err := m.Set(ctx, a.Add(time.Second*time.Duration(idx)), "key", []byte(fmt.Sprint(idx)))
+		if err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+	err = m.Close(ctx)
+	if err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(ctx)
+	value, err := m.Get(ctx, a.Add(time.Second*2), "key")
+	if err != nil || string(value) != "2" {
+		t.Fatalf("expected 2, have %q %v", value, err)
+	}
+}
+
+// blockingStorage holds up chunk writes until release is closed
+type blockingStorage struct {
+	storage.System
+	release chan struct{}
+}
+
+func (s *blockingStorage) Write(ctx context.Context, key string, data []byte) error {
+	if strings.HasSuffix(key, ".chunk") {
+		<-s.release
+	}
+	return s.System.Write(ctx, key, data)
+}
+
+func TestMapBackgroundChunking(t *testing.T) {
+	s := &blockingStorage{System: storage.NewMemoryStorage(), release: make(chan struct{})}
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 1, ChunkQueue: 1})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	// The first write starts a chunk that can't be saved, writes carry on without it
+	ctx := context.Background()
+	a := time.Now()
+	for idx := range 10 {
+		err := m.Set(ctx, a.Add(time.Second*time.Duration(idx)), "key", []byte(fmt.Sprint(idx)))
+		if err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+
+	// Queue another chunk behind it, then the queue is full
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := m.Flush(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the flush to time out, have %v", err)
+	}
+	short, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = m.Set(short, a.Add(time.Second*10), "key", []byte("10"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the set to wait for the queue, have %v", err)
+	}
+
+	for idx := range 10 {
+		value, err := m.Get(ctx, a.Add(time.Second*time.Duration(idx)), "key")
+		if err != nil || string(value) != fmt.Sprint(idx) {
+			t.Fatalf("expected %d before it is chunked, have %q %v", idx, value, err)
+		}
+	}
+
+	close(s.release)
+	err = m.Flush(ctx)
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	keys, _ := s.GetKeysWithPrefix(ctx, "events/")
+	if len(keys) > 1 {
+		t.Fatalf("expected at most the open event log, have %v", keys)
+	}
+	m.Close(ctx)
+
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(ctx)
+	for idx := range 10 {
+		value, err := m.Get(ctx, a.Add(time.Second*time.Duration(idx)), "key")
+		if err != nil || string(value) != fmt.Sprint(idx) {
+			t.Fatalf("expected %d from the chunks, have %q %v", idx, value, err)
+		}
+	}
+}
+
+func TestMapClose(t *testing.T) {
+	ctx := context.Background()
+	s := &blockingStorage{System: storage.NewMemoryStorage(), release: make(chan struct{})}
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 1})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	a := time.Now()
+	for idx := range 3 {
+		err := m.Set(ctx, a.Add(time.Second*time.Duration(idx)), "key", []byte(fmt.Sprint(idx)))
+		if err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+
+	// Close waits for the chunks that are queued
+	closed := make(chan error)
+	go func() {
+		closed <- m.Close(ctx)
+	}()
+	select {
+	case err := <-closed:
+		t.Fatalf("expected close to wait for the chunk worker, have %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(s.release)
+	if err := <-closed; err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if _, err := m.Get(ctx, a, "key"); !errors.Is(err, ErrMapClosed) {
+		t.Fatalf("expected the map to be closed, have %v", err)
+	}
+
+	// Only the open event log is left to be chunked when the map is opened again
+	keys, _ := s.GetKeysWithPrefix(ctx, "events/")
+	if len(keys) != 1 {
+		t.Fatalf("expected the open event log, have %v", keys)
+	}
+	m, err = NewMap(s)
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(ctx)
+	for idx := range 3 {
+		value, err := m.Get(ctx, a.Add(time.Second*time.Duration(idx)), "key")
+		if err != nil || string(value) != fmt.Sprint(idx) {
+			t.Fatalf("expected %d, have %q %v", idx, value, err)
+		}
+	}
+}
+
+func TestMapFlushPolicy(t *testing.T) {
+	ctx := context.Background()
+	a := time.Now().Truncate(time.Minute).Add(time.Hour)
+
+	chunkNames := func(s storage.System) []string {
+		keys, _ := s.GetKeysWithPrefix(ctx, "")
+		names := []string{}
+		for _, key := range keys {
+			if strings.HasSuffix(key, ".chunk") {
+				names = append(names, key)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, test := range []struct {
+		policy FlushPolicy
+		chunks []time.Duration // Where each chunk starts
+	}{
+		{FlushOnBoundary{Every: 10 * time.Second}, []time.Duration{0, 10 * time.Second, 20 * time.Second}},
+		{FlushOnCount{Events: 12}, []time.Duration{0, 12 * time.Second, 24 * time.Second}},
+		{FlushAny(FlushOnCount{Events: 25}, FlushOnBoundary{Every: 20 * time.Second}), []time.Duration{0, 20 * time.Second}},
+	} {
+		s := storage.NewMemoryStorage()
+		m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, FlushPolicy: test.policy})
+		if err != nil {
+			t.Fatalf("could not create map: %v", err)
+		}
+		for idx := range 30 {
+			err := m.Set(ctx, a.Add(time.Second*time.Duration(idx)), "key", []byte(fmt.Sprint(idx)))
+			if err != nil {
+				t.Fatalf("set failed: %v", err)
+			}
+		}
+		err = m.Flush(ctx)
+		if err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+
+		expected := []string{}
+		for _, start := range test.chunks {
+			expected = append(expected, a.Add(start).UTC().Format("20060102_150405.000000000")+".chunk")
+		}
+		if names := chunkNames(s); fmt.Sprint(names) != fmt.Sprint(expected) {
+			t.Fatalf("%T: expected chunks %v, have %v", test.policy, expected, names)
+		}
+
+		value, err := m.Get(ctx, a.Add(time.Second*15), "key")
+		if err != nil || string(value) != "15" {
+			t.Fatalf("expected 15, have %q %v", value, err)
+		}
+		m.Close(ctx)
+	}
+}
+
+// TestMapReadWhileChunking reads from the index while the worker adds chunks to it, run
+// it with -race
+func TestMapReadWhileChunking(t *testing.T) {
+	ctx := context.Background()
+	a := time.Now().Truncate(time.Minute).Add(time.Hour)
+
+	m, err := NewMapWithConfig(storage.NewMemoryStorage(), MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, FlushPolicy: FlushOnCount{Events: 5}})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(ctx)
+
+	const writes = 200
+	done := make(chan error)
+	go func() {
+		for idx := range writes {
+			err := m.Set(ctx, a.Add(time.Second*time.Duration(idx)), fmt.Sprint("key", idx%7), []byte(fmt.Sprint(idx)))
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for reading := true; reading; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("set failed: %v", err)
+			}
+			reading = false
+		default:
+		}
+		at := a.Add(time.Second * time.Duration(rand.Intn(writes)))
+		_, err := m.GetAll(ctx, at)
+		if err != nil {
+			t.Fatalf("get all failed: %v", err)
+		}
+		_, err = m.Get(ctx, at, "key0")
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		m.GetMinTime()
+		m.GetMaxTime()
+	}
+
+	err = m.Flush(ctx)
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	for idx := range writes {
+		value, err := m.Get(ctx, a.Add(time.Second*time.Duration(idx)), fmt.Sprint("key", idx%7))
+		if err != nil || string(value) != fmt.Sprint(idx) {
+			t.Fatalf("expected %d, have %q %v", idx, value, err)
+		}
+	}
+}
+
+// chunkingIndex runs chunk before or after each history read, as the worker might
+type chunkingIndex struct {
+	chunks.Index
+	chunk func()
+	after bool
+}
+
+func (i chunkingIndex) GetRangeHistory(ctx context.Context, r misc.KeyRange, from time.Time, to time.Time) ([]chunks.Event, error) {
+	if !i.after {
+		i.chunk()
+	}
+	events, err := i.Index.GetRangeHistory(ctx, r, from, to)
+	if i.after {
+		i.chunk()
+	}
+	return events, err
+}
+
+func (i chunkingIndex) GetChanges(ctx context.Context, from time.Time, to time.Time) (map[string]chunks.KeyChange, error) {
+	if !i.after {
+		i.chunk()
+	}
+	changes, err := i.Index.GetChanges(ctx, from, to)
+	if i.after {
+		i.chunk()
+	}
+	return changes, err
+}
+
+func TestMapHistoryWhileChunking(t *testing.T) {
+	ctx := context.Background()
+	a := time.Now().Truncate(time.Minute).Add(time.Hour)
+
+	for _, after := range []bool{false, true} {
+		m, err := NewMap(storage.NewMemoryStorage())
+		if err != nil {
+			t.Fatalf("could not create map: %v", err)
+		}
+		for idx := 1; idx <= 5; idx++ {
+			err := m.Set(ctx, a.Add(time.Second*time.Duration(idx)), "key", []byte(fmt.Sprint("v", idx)))
+			if err != nil {
+				t.Fatalf("set failed: %v", err)
+			}
+			if idx == 2 {
+				m.Flush(ctx)
+			}
+		}
+
+		// The rest of the writes are chunked part way through reading the history
+		tm := m.(*temporalMap)
+		index := tm.index
+		tm.index = chunkingIndex{Index: index, after: after, chunk: func() {
+			tm.eventSink.Flush(ctx, tm.current)
+		}}
+		versions, err := m.History(ctx, "key", a, a.Add(time.Second*6))
+		if err != nil {
+			t.Fatalf("history failed: %v", err)
+		}
+		values := []string{}
+		for _, v := range versions {
+			values = append(values, string(v.Data))
+		}
+		if fmt.Sprint(values) != "[v1 v2 v3 v4 v5]" {
+			t.Fatalf("after %v: expected every version once, have %v", after, values)
+		}
+
+		changes, err := m.Changes(ctx, a.Add(time.Second), a.Add(time.Second*6))
+		if err != nil || len(changes) != 1 || string(changes[0].Before) != "v1" || string(changes[0].After) != "v5" {
+			t.Fatalf("after %v: expected v1 to v5, have %v %v", after, changes, err)
+		}
+		tm.index = index
+		m.Close(ctx)
+	}
+}
+
+func TestMapChunkSizeWithoutKeyFrame(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	m, err := NewMapWithConfig(s, MapConfig{MaxChunkTargetSize: 64 * 1024})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+
+	chunkCount := func() int {
+		keys, _ := s.GetKeysWithPrefix(ctx, "")
+		count := 0
+		for _, key := range keys {
+			if strings.HasSuffix(key, ".chunk") {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Far more state than fits in a chunk
+	random := rand.New(rand.NewSource(1))
+	value := func() []byte {
+		b := make([]byte, 100)
+		random.Read(b)
+		return b
+	}
+	a := time.Now().Truncate(time.Minute).Add(time.Hour)
+	for idx := range 1000 {
+		err := m.Set(ctx, a.Add(time.Millisecond*time.Duration(idx)), fmt.Sprint("key", idx), value())
+		if err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+	err = m.Flush(ctx)
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	before := chunkCount()
+
+	// Less than a chunk of updates to a few keys doesn't make a chunk, however big the
+	// state it carries over is
+	for idx := range 300 {
+		err := m.Set(ctx, a.Add(time.Second*3+time.Millisecond*time.Duration(idx)), fmt.Sprint("key", idx%10), value())
+		if err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+	m.Close(ctx) // Waits for the chunks that were queued
+	if after := chunkCount(); after != before {
+		t.Fatalf("expected no more than %d chunks, have %d", before, after)
+	}
+}
+
+func TestMapEventsTrimmed(t *testing.T) {
+	ctx := context.Background()
+	a := time.Now().Truncate(time.Minute).Add(time.Hour)
+
+	m, err := NewMapWithConfig(storage.NewMemoryStorage(), MapConfig{MaxChunkTargetSize: 8 * 1024 * 1024, FlushPolicy: FlushOnCount{Events: 5}})
+	if err != nil {
+		t.Fatalf("could not create map: %v", err)
+	}
+	defer m.Close(ctx)
+
+	for idx := range 20 {
+		err := m.Set(ctx, a.Add(time.Second*time.Duration(idx)), fmt.Sprint("key", idx%3), []byte(fmt.Sprint(idx)))
+		if err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+	err = m.Flush(ctx)
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	// Only the last write is at the index's max time, everything else is in a chunk
+	history := m.(*temporalMap).eventMap.GetRangeHistory(a, a.Add(time.Minute), misc.KeyRange{})
+	if len(history) != 1 || len(history["key1"]) != 1 {
+		t.Fatalf("expected only the last write in the event map, have %v", history)
+	}
+
+	for idx := range 20 {
+		value, err := m.Get(ctx, a.Add(time.Second*time.Duration(idx)), fmt.Sprint("key", idx%3))
+		if err != nil || string(value) != fmt.Sprint(idx) {
+			t.Fatalf("expected %d, have %q %v", idx, value, err)
+		}
+	}
+	changes, err := m.Changes(ctx, a, a.Add(time.Second*19))
+	if err != nil || len(changes) != 3 || string(changes[1].After) != "19" {
+		t.Fatalf("expected changes to every key, have %v %v", changes, err)
+	}
+}
@@ -27,7 +27,7 @@ func NewMeta(storage storage.System) (Meta, error) {
 	}
 
 	// Build/Load indexes
-	index, err := chunks.NewChunkIndex(storage, time.Duration(0), telemetry.NOPLogger{}, telemetry.NOPMetrics{})
+	index, err := chunks.NewChunkIndex(context.Background(), storage, chunks.RetentionPolicy{}, nil, chunks.Checkpoints{}, chunks.Corruption{}, 0, telemetry.NOPLogger{}, telemetry.NOPMetrics{})
 	if err != nil {
 		return nil, err
 	}
@@ -39,9 +39,9 @@ func NewMeta(storage storage.System) (Meta, error) {
 	}
 
 	fmt.Println("Events")
-	keys, _ := sinkMeta.GetEventFiles()
+	keys, _ := sinkMeta.GetEventFiles(context.Background())
 	for _, k := range keys {
-		events, _ := events.GetEvents(storage, k)
+		events, _ := events.GetEvents(context.Background(), storage, k)
 		fmt.Printf("	%s:%d events\n", k, len(events))
 	}
 
@@ -0,0 +1,215 @@
+package misc
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Everything written to storage is framed as magic, format version, codec id, a crc32
+// of the payload and then the codec's payload.  Version 1 frames have no checksum and
+// data written before framing is bare gob inside gzip, gzip's own magic can't be
+// mistaken for ours.
+var frameMagic = []byte("TMPF")
+
+const (
+	frameVersion   = 2
+	frameHeader    = 10
+	frameHeaderV1  = 6
+	checksumOffset = 6
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksum is returned when a frame's payload doesn't match its checksum
+var ErrChecksum = errors.New("checksum mismatch")
+
+// Codec turns a value into bytes and back.  Id is written into every frame the codec
+// makes so it has to be unique and can never change.
+type Codec interface {
+	Id() byte
+	Marshal(data any) ([]byte, error)
+	Unmarshal(b []byte, a any) error
+}
+
+var (
+	GobCodec     Codec = gobCodec{}                           // Uncompressed gob
+	GobGzipCodec Codec = gobGzipCodec{}                       // Gob inside gzip, the format before framing
+	GobFlate     Codec = FlateCodec(flate.DefaultCompression) // Gob inside flate
+)
+
+// FlateCodec is gob inside flate at level, every level is read by the same codec
+func FlateCodec(level int) Codec {
+	return gobFlateCodec{level: level}
+}
+
+var (
+	codecLock    sync.RWMutex
+	codecs       = map[byte]Codec{}
+	defaultCodec = GobGzipCodec
+)
+
+func init() {
+	RegisterCodec(GobCodec)
+	RegisterCodec(GobGzipCodec)
+	RegisterCodec(GobFlate)
+}
+
+// RegisterCodec makes frames written by codec readable, it panics if the id is taken
+func RegisterCodec(codec Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	if _, ok := codecs[codec.Id()]; ok {
+		panic(fmt.Sprintf("codec %d registered twice", codec.Id()))
+	}
+	codecs[codec.Id()] = codec
+}
+
+// SetDefaultCodec chooses the codec EncodeToBytes uses, it has to be registered so what
+// it writes can be read back
+func SetDefaultCodec(codec Codec) error {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	if _, ok := codecs[codec.Id()]; !ok {
+		return errors.Errorf("codec %d is not registered", codec.Id())
+	}
+	defaultCodec = codec
+	return nil
+}
+
+// EncodeToBytes serializes and compresses the data with the default codec
+func EncodeToBytes(data any) ([]byte, error) {
+	codecLock.RLock()
+	codec := defaultCodec
+	codecLock.RUnlock()
+	return EncodeWith(codec, data)
+}
+
+// EncodeWith serializes the data with codec
+func EncodeWith(codec Codec, data any) ([]byte, error) {
+	payload, err := codec.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, frameHeader+len(payload))
+	b = append(b, frameMagic...)
+	b = append(b, frameVersion, codec.Id())
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(payload, crcTable))
+	return append(b, payload...), nil
+}
+
+// DecodeFromBytes deserializes data written by any version of EncodeToBytes
+func DecodeFromBytes(data []byte, a any) error {
+	if !bytes.HasPrefix(data, frameMagic) {
+		return gobGzipCodec{}.Unmarshal(data, a)
+	}
+	if len(data) < frameHeaderV1 {
+		return errors.New("truncated frame")
+	}
+
+	version, id := data[len(frameMagic)], data[len(frameMagic)+1]
+	var payload []byte
+	switch version {
+	case 1:
+		payload = data[frameHeaderV1:]
+	case 2:
+		if len(data) < frameHeader {
+			return errors.New("truncated frame")
+		}
+		payload = data[frameHeader:]
+		if binary.BigEndian.Uint32(data[checksumOffset:]) != crc32.Checksum(payload, crcTable) {
+			return ErrChecksum
+		}
+	default:
+		return errors.Errorf("unsupported frame version %d", version)
+	}
+
+	codecLock.RLock()
+	codec, ok := codecs[id]
+	codecLock.RUnlock()
+	if !ok {
+		return errors.Errorf("unknown codec %d", id)
+	}
+	return codec.Unmarshal(payload, a)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Id() byte { return 0 }
+
+func (gobCodec) Marshal(data any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, a any) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(a)
+}
+
+type gobGzipCodec struct{}
+
+func (gobGzipCodec) Id() byte { return 1 }
+
+func (gobGzipCodec) Marshal(data any) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	err := gob.NewEncoder(gz).Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close() // Ensure all data is flushed
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobGzipCodec) Unmarshal(b []byte, a any) error {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	return gob.NewDecoder(gz).Decode(a)
+}
+
+type gobFlateCodec struct {
+	level int
+}
+
+func (gobFlateCodec) Id() byte { return 2 }
+
+func (c gobFlateCodec) Marshal(data any) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	err = gob.NewEncoder(fw).Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	err = fw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobFlateCodec) Unmarshal(b []byte, a any) error {
+	fr := flate.NewReader(bytes.NewReader(b))
+	defer fr.Close()
+	return gob.NewDecoder(fr).Decode(a)
+}
@@ -0,0 +1,90 @@
+package misc
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/gob"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+)
+
+type encodingTest struct {
+	Name   string
+	Values map[string][]byte
+}
+
+func TestEncoding(t *testing.T) {
+	value := encodingTest{Name: "test", Values: map[string][]byte{"a": []byte("1"), "b": []byte("2")}}
+
+	for _, codec := range []Codec{GobCodec, GobGzipCodec, GobFlate, FlateCodec(flate.BestSpeed), FlateCodec(flate.BestCompression)} {
+		b, err := EncodeWith(codec, value)
+		if err != nil {
+			t.Fatalf("encode failed: %v", err)
+		}
+		if !bytes.HasPrefix(b, frameMagic) || b[len(frameMagic)] != frameVersion || b[len(frameMagic)+1] != codec.Id() {
+			t.Fatalf("unexpected frame header %v", b[:frameHeader])
+		}
+
+		var decoded encodingTest
+		err = DecodeFromBytes(b, &decoded)
+		if err != nil {
+			t.Fatalf("decode failed: %v", err)
+		}
+		if decoded.Name != value.Name || string(decoded.Values["b"]) != "2" {
+			t.Fatalf("expected %v, got %v", value, decoded)
+		}
+	}
+
+	// Data written before framing is gob inside gzip
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gob.NewEncoder(gz).Encode(value)
+	gz.Close()
+	var decoded encodingTest
+	err := DecodeFromBytes(buf.Bytes(), &decoded)
+	if err != nil || decoded.Name != value.Name {
+		t.Fatalf("could not decode legacy data: %v %v", decoded, err)
+	}
+
+	// Version 1 frames have no checksum
+	b, _ := EncodeWith(GobCodec, value)
+	v1 := append(append([]byte{}, b[:frameHeaderV1]...), b[frameHeader:]...)
+	v1[len(frameMagic)] = 1
+	err = DecodeFromBytes(v1, &decoded)
+	if err != nil || decoded.Name != value.Name {
+		t.Fatalf("could not decode version 1 frame: %v %v", decoded, err)
+	}
+
+	b[len(b)-1] ^= 0xff
+	if !errors.Is(DecodeFromBytes(b, &decoded), ErrChecksum) {
+		t.Fatalf("expected a flipped bit to fail the checksum")
+	}
+	b[len(b)-1] ^= 0xff
+	if DecodeFromBytes(b[:len(b)-1], &decoded) == nil {
+		t.Fatalf("expected a truncated payload to fail")
+	}
+
+	b[len(frameMagic)] = frameVersion + 1
+	if DecodeFromBytes(b, &decoded) == nil {
+		t.Fatalf("expected a newer version to fail")
+	}
+	b[len(frameMagic)], b[len(frameMagic)+1] = frameVersion, 200
+	if DecodeFromBytes(b, &decoded) == nil {
+		t.Fatalf("expected an unknown codec to fail")
+	}
+	if DecodeFromBytes(frameMagic, &decoded) == nil {
+		t.Fatalf("expected a truncated frame to fail")
+	}
+
+	err = SetDefaultCodec(GobFlate)
+	if err != nil {
+		t.Fatalf("could not set default codec: %v", err)
+	}
+	defer SetDefaultCodec(GobGzipCodec)
+	b, _ = EncodeToBytes(value)
+	if b[len(frameMagic)+1] != GobFlate.Id() {
+		t.Fatalf("expected the default codec to be used")
+	}
+}
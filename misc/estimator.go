@@ -35,7 +35,10 @@ func (e *CompressionEstimator) OnFlush(compressedSize int64, success bool) {
 	e.lock.Lock()
 	defer e.lock.Unlock()
 
-	e.compressionRatio = float64(compressedSize) / float64(e.currentSize)
+	// Nothing was written or nothing was produced, there is nothing to learn from this flush
+	if e.currentSize > 0 && compressedSize > 0 {
+		e.compressionRatio = float64(compressedSize) / float64(e.currentSize)
+	}
 
 	if success {
 		e.currentSize = 0
@@ -0,0 +1,43 @@
+package misc
+
+// KeyRange selects the keys in [Start, End).  An empty End has no upper bound, so the
+// zero value selects every key.
+type KeyRange struct {
+	Start string
+	End   string
+}
+
+func (r KeyRange) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+func (r KeyRange) IsAll() bool {
+	return r.Start == "" && r.End == ""
+}
+
+// Key returns the only key in the range if it selects exactly one
+func (r KeyRange) Key() (string, bool) {
+	if r.End == r.Start+"\x00" {
+		return r.Start, true
+	}
+	return "", false
+}
+
+// SingleKey returns the range that selects only key
+func SingleKey(key string) KeyRange {
+	return KeyRange{Start: key, End: key + "\x00"}
+}
+
+// PrefixRange returns the range of keys that start with prefix
+func PrefixRange(prefix string) KeyRange {
+	end := []byte(prefix)
+	for len(end) > 0 {
+		if end[len(end)-1] < 0xff {
+			end[len(end)-1]++
+			return KeyRange{Start: prefix, End: string(end)}
+		}
+		end = end[:len(end)-1]
+	}
+	// The prefix is empty or all 0xff bytes, nothing sorts after it
+	return KeyRange{Start: prefix}
+}
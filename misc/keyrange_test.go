@@ -0,0 +1,22 @@
+package misc
+
+import "testing"
+
+func TestPrefixRange(t *testing.T) {
+	r := PrefixRange("users/42/")
+	if !r.Contains("users/42/") || !r.Contains("users/42/name") {
+		t.Fatalf("expected prefix keys to be in range")
+	}
+	if r.Contains("users/420") || r.Contains("users/41/name") || r.Contains("users/43/") {
+		t.Fatalf("expected other keys to be out of range")
+	}
+
+	r = PrefixRange("a\xff")
+	if !r.Contains("a\xff\xff") || r.Contains("b") {
+		t.Fatalf("unexpected range for trailing 0xff: %v", r)
+	}
+
+	if !PrefixRange("").IsAll() {
+		t.Fatalf("expected empty prefix to select everything")
+	}
+}
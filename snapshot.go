@@ -0,0 +1,116 @@
+package temporal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/hoyle1974/temporal/misc"
+)
+
+// ErrSnapshotClosed is returned by every call made on a Snapshot after Close
+var ErrSnapshotClosed = errors.New("snapshot closed")
+
+// Snapshot is a read-only view of the map pinned to a single point in time.  The state is
+// reconstructed once when the snapshot is taken, so reads don't touch the index and are
+// not affected by later writes.
+type Snapshot interface {
+	Timestamp() time.Time
+	Get(ctx context.Context, key string) ([]byte, error)
+	GetAll(ctx context.Context) (map[string][]byte, error)
+	GetRange(ctx context.Context, startKey string, endKey string) ([]KeyValue, error)
+	GetPrefix(ctx context.Context, prefix string) ([]KeyValue, error)
+	// Close releases the state held by the snapshot
+	Close()
+}
+
+type snapshot struct {
+	_         misc.NoCopy
+	lock      sync.RWMutex
+	timestamp time.Time
+	state     map[string][]byte
+}
+
+// Snapshot implements ReadWriteMap.  A zero timestamp, or one at or after the latest
+// write, pins the state as it is when the snapshot is taken.
+func (t *temporalMap) Snapshot(ctx context.Context, timestamp time.Time) (Snapshot, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return nil, ErrMapClosed
+	}
+
+	if timestamp.IsZero() || timestamp.After(t.current) {
+		timestamp = t.current
+	}
+
+	state, err := t.getRangeStateAt(ctx, timestamp, misc.KeyRange{})
+	if err != nil {
+		return nil, errors.Wrap(err, "can not build snapshot")
+	}
+
+	return &snapshot{timestamp: timestamp, state: state}, nil
+}
+
+func (s *snapshot) Timestamp() time.Time {
+	return s.timestamp
+}
+
+func (s *snapshot) Get(ctx context.Context, key string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.state == nil {
+		return nil, ErrSnapshotClosed
+	}
+	return s.state[key], nil
+}
+
+func (s *snapshot) GetAll(ctx context.Context) (map[string][]byte, error) {
+	return s.getRange(misc.KeyRange{})
+}
+
+// GetRange returns the keys in [startKey, endKey) in sorted order, an empty endKey has
+// no upper bound.
+func (s *snapshot) GetRange(ctx context.Context, startKey string, endKey string) ([]KeyValue, error) {
+	state, err := s.getRange(misc.KeyRange{Start: startKey, End: endKey})
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeyValues(state), nil
+}
+
+// GetPrefix returns the keys starting with prefix in sorted order.
+func (s *snapshot) GetPrefix(ctx context.Context, prefix string) ([]KeyValue, error) {
+	state, err := s.getRange(misc.PrefixRange(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeyValues(state), nil
+}
+
+func (s *snapshot) getRange(r misc.KeyRange) (map[string][]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.state == nil {
+		return nil, ErrSnapshotClosed
+	}
+
+	state := map[string][]byte{}
+	for k, v := range s.state {
+		if r.Contains(k) {
+			state[k] = v
+		}
+	}
+	return state, nil
+}
+
+func (s *snapshot) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = nil
+}
@@ -6,12 +6,14 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/cockroachdb/errors"
 )
 
 type diskStorage struct {
-	BaseDir string
+	BaseDir   string
+	eventLock sync.Mutex
 }
 
 // NewDiskStorage initializes a new DiskStorage instance
@@ -24,6 +26,11 @@ func NewDiskStorage(baseDir string) *diskStorage {
 	return &diskStorage{BaseDir: baseDir}
 }
 
+// EventLock implements EventLocker
+func (ds *diskStorage) EventLock() sync.Locker {
+	return &ds.eventLock
+}
+
 func (ds *diskStorage) GetKeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
 	var matchedFiles []string
 
@@ -35,8 +42,8 @@ func (ds *diskStorage) GetKeysWithPrefix(ctx context.Context, prefix string) ([]
 			return errors.Wrap(err, "can not walk directory")
 		}
 
-		// Check if it's a file and starts with the prefix
-		if !d.IsDir() && strings.HasPrefix(path, searchPrefix) {
+		// Check if it's a file and starts with the prefix, skipping writes in progress
+		if !d.IsDir() && strings.HasPrefix(path, searchPrefix) && !strings.HasPrefix(d.Name(), ".tmp-") {
 			matchedFiles = append(matchedFiles, path[len(ds.BaseDir)+1:])
 		}
 		return nil
@@ -53,6 +60,11 @@ func (m *diskStreamWriter) Write(data []byte) (int, error) {
 	return m.file.Write(data)
 }
 
+// Sync flushes the file to disk
+func (m *diskStreamWriter) Sync() error {
+	return m.file.Sync()
+}
+
 func (m *diskStreamWriter) Close() error {
 	return m.file.Close()
 }
@@ -84,7 +96,27 @@ func (ds *diskStorage) Write(ctx context.Context, key string, data []byte) error
 		return errors.Wrap(err, "can not create directory")
 	}
 
-	return os.WriteFile(filePath, data, 0644)
+	// Write to a temporary file and rename it so readers never see a partial write
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-"+filepath.Base(filePath))
+	if err != nil {
+		return errors.Wrap(err, "can not create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "can not write temporary file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "can not close temporary file")
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrap(err, "can not set file mode")
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return errors.Wrap(err, "can not rename temporary file")
+	}
+	return nil
 }
 
 // Read reads data from a file for a given key
@@ -5,19 +5,27 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/cockroachdb/errors"
+
 	"github.com/hoyle1974/temporal/misc"
 )
 
 type memoryStorage struct {
-	_    misc.NoCopy
-	lock sync.Mutex
-	data map[string][]byte
+	_         misc.NoCopy
+	lock      sync.Mutex
+	eventLock sync.Mutex
+	data      map[string][]byte
 }
 
 func NewMemoryStorage() *memoryStorage {
 	return &memoryStorage{data: make(map[string][]byte)}
 }
 
+// EventLock implements EventLocker
+func (m *memoryStorage) EventLock() sync.Locker {
+	return &m.eventLock
+}
+
 func (m *memoryStorage) GetKeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -34,6 +42,12 @@ func (m *memoryStorage) GetKeysWithPrefix(ctx context.Context, prefix string) ([
 }
 
 func (m *memoryStorage) Write(ctx context.Context, key string, data []byte) error {
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "context canceled")
+	default:
+	}
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
@@ -62,6 +76,12 @@ func (m *memoryStreamWriter) Write(data []byte) (int, error) {
 	return ol, nil
 }
 
+// Sync does nothing, every write is already visible to readers and nothing survives
+// the process anyway
+func (m *memoryStreamWriter) Sync() error {
+	return nil
+}
+
 func (m *memoryStreamWriter) Close() error {
 	return nil
 }
@@ -75,6 +95,12 @@ func (s *memoryStorage) BeginStream(ctx context.Context, key string) StreamWrite
 
 // ReadFile reads data from a file for a given timestamp and granularity
 func (m *memoryStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "context canceled")
+	default:
+	}
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
@@ -88,6 +114,12 @@ func (m *memoryStorage) Read(ctx context.Context, key string) ([]byte, error) {
 
 // DeleteFile deletes a file for a given timestamp and granularity
 func (m *memoryStorage) Delete(ctx context.Context, key string) error {
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "context canceled")
+	default:
+	}
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
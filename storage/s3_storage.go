@@ -21,6 +21,7 @@ import (
 type s3Storage struct {
 	Client     *s3.Client
 	BucketName string
+	eventLock  sync.Mutex
 }
 
 // NewS3Storage initializes a new S3Storage instance
@@ -28,6 +29,16 @@ func NewS3Storage(client *s3.Client, bucketName string) *s3Storage {
 	return &s3Storage{Client: client, BucketName: bucketName}
 }
 
+// EventLock implements EventLocker, it is only shared by maps opened on this value
+func (s *s3Storage) EventLock() sync.Locker {
+	return &s.eventLock
+}
+
+// CanSync implements SyncSupport, streams are only durable once they are closed
+func (s *s3Storage) CanSync() bool {
+	return false
+}
+
 func (s *s3Storage) GetKeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
 	var matchedFiles []string
 	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
@@ -78,6 +89,12 @@ func (s *s3StreamWriter) Write(data []byte) (int, error) {
 	return n, nil
 }
 
+// Sync always fails, an S3 object only exists once its upload finishes so the stream is
+// durable when it is closed and not before
+func (s *s3StreamWriter) Sync() error {
+	return ErrSyncUnsupported
+}
+
 func (s *s3StreamWriter) Close() error {
 	// Ensure any remaining data is flushed before closing
 	err := s.writer.Flush()
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"sync"
 )
 
 type StreamWriter interface {
@@ -11,6 +12,57 @@ type StreamWriter interface {
 	io.Closer
 }
 
+// Syncer is implemented by stream writers that can make what has been written so far
+// survive a crash before the stream is closed
+type Syncer interface {
+	Sync() error
+}
+
+// Sync makes what has been written to w durable if w supports it
+func Sync(w StreamWriter) error {
+	if s, ok := w.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// ErrSyncUnsupported is returned by Sync when a stream is only durable once it is closed
+var ErrSyncUnsupported = errors.New("sync is not supported")
+
+// SyncSupport is implemented by storage systems whose streams may not support Sync
+type SyncSupport interface {
+	CanSync() bool
+}
+
+// CanSync reports whether streams from s can be made durable before they are closed
+func CanSync(s System) bool {
+	if c, ok := s.(SyncSupport); ok {
+		return c.CanSync()
+	}
+	return true
+}
+
+// EventLocker is implemented by storage systems with a lock that maps opened on them hold
+// while they turn event logs into chunks.  A map opened while another on the same storage
+// is still chunking, because it wasn't closed, waits for it instead of building the same
+// chunks.
+type EventLocker interface {
+	EventLock() sync.Locker
+}
+
+// EventLock returns the lock s holds for chunking event logs, or one that does nothing
+func EventLock(s System) sync.Locker {
+	if l, ok := s.(EventLocker); ok {
+		return l.EventLock()
+	}
+	return noLock{}
+}
+
+type noLock struct{}
+
+func (noLock) Lock()   {}
+func (noLock) Unlock() {}
+
 var ErrDoesNotExist = errors.New("does not exist")
 
 // System defines the operations for interacting with the storage backend
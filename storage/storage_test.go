@@ -69,6 +69,13 @@ func TestStreamWrite(t *testing.T) {
 			require.NoError(t, err)
 			require.Equal(t, len(data), n)
 
+			err = Sync(stream)
+			if CanSync(tt.storage) {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrSyncUnsupported)
+			}
+
 			err = stream.Close()
 			require.NoError(t, err)
 
@@ -0,0 +1,226 @@
+package temporal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/hoyle1974/temporal/misc"
+)
+
+// ErrSubscriberOverflow is reported by a Subscription whose consumer fell too far
+// behind the writers.  The events channel is closed and no further events are sent.
+var ErrSubscriberOverflow = errors.New("subscriber overflow")
+
+const defaultSubscriberBuffer = 1024
+
+// Event is a single write delivered to a Subscription
+type Event struct {
+	Timestamp time.Time
+	Key       string
+	Data      []byte
+	Delete    bool
+}
+
+type Subscription interface {
+	// Events delivers writes in timestamp order.  It is closed when the subscription ends.
+	Events() <-chan Event
+	// Err reports why Events was closed, it is nil if Close was called.
+	Err() error
+	Close()
+}
+
+// subscriber queues events for a consumer so that writers never block on it.  If more
+// than limit live events are waiting the subscriber is ended with ErrSubscriberOverflow,
+// the history replayed first doesn't count against it.
+type subscriber struct {
+	_      misc.NoCopy
+	lock   sync.Mutex
+	r      misc.KeyRange
+	replay []Event // Delivered before queue
+	queue  []Event
+	limit  int
+	taken  bool // Whether the event being delivered came from replay
+	ended  bool
+	err    error
+	notify chan struct{}
+	out    chan Event
+}
+
+func newSubscriber(r misc.KeyRange, limit int, replay []Event) *subscriber {
+	return &subscriber{
+		r:      r,
+		replay: replay,
+		limit:  limit,
+		notify: make(chan struct{}, 1),
+		out:    make(chan Event),
+	}
+}
+
+func (s *subscriber) Events() <-chan Event {
+	return s.out
+}
+
+func (s *subscriber) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+func (s *subscriber) Close() {
+	s.end(nil)
+}
+
+// push is called by writers and must never block
+func (s *subscriber) push(e Event) {
+	if !s.r.Contains(e.Key) {
+		return
+	}
+
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	if len(s.queue) >= s.limit {
+		s.lock.Unlock()
+		s.end(ErrSubscriberOverflow)
+		return
+	}
+	s.queue = append(s.queue, e)
+	s.lock.Unlock()
+
+	s.wake()
+}
+
+func (s *subscriber) end(err error) {
+	s.lock.Lock()
+	if !s.ended {
+		s.ended = true
+		s.err = err
+		s.replay = nil
+		s.queue = nil
+	}
+	s.lock.Unlock()
+
+	s.wake()
+}
+
+func (s *subscriber) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) next() (Event, bool, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.ended {
+		return Event{}, false, true
+	}
+	if len(s.replay) > 0 {
+		e := s.replay[0]
+		s.replay = s.replay[1:]
+		s.taken = true
+		return e, true, false
+	}
+	if len(s.queue) == 0 {
+		return Event{}, false, false
+	}
+	e := s.queue[0]
+	s.queue = s.queue[1:]
+	s.taken = false
+	return e, true, false
+}
+
+// putBack returns the event next gave out to the front of where it came from
+func (s *subscriber) putBack(e Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.ended {
+		return
+	}
+	if s.taken {
+		s.replay = append([]Event{e}, s.replay...)
+	} else {
+		s.queue = append([]Event{e}, s.queue...)
+	}
+}
+
+// run delivers queued events to the consumer until the subscription ends
+func (s *subscriber) run(ctx context.Context, done func()) {
+	defer done()
+	defer close(s.out)
+
+	for {
+		e, ok, ended := s.next()
+		if ended {
+			return
+		}
+		if !ok {
+			select {
+			case <-s.notify:
+			case <-ctx.Done():
+				s.end(ctx.Err())
+			}
+			continue
+		}
+
+		select {
+		case s.out <- e:
+		case <-s.notify:
+			// Woken while waiting on the consumer, put the event back and check if we ended
+			s.putBack(e)
+		case <-ctx.Done():
+			s.end(ctx.Err())
+		}
+	}
+}
+
+// Subscribe implements ReadWriteMap.  It first replays every write to keys starting with
+// prefix made at or after since, then delivers new writes as they are accepted.
+func (t *temporalMap) Subscribe(ctx context.Context, prefix string, since time.Time) (Subscription, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return nil, ErrMapClosed
+	}
+
+	r := misc.PrefixRange(prefix)
+
+	replay := []Event{}
+	if !since.After(t.current) {
+		history, err := t.history(ctx, r, since, t.current)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not replay history")
+		}
+		for _, e := range history {
+			replay = append(replay, Event{Timestamp: e.Timestamp, Key: e.Key, Data: e.Data, Delete: e.Delete})
+		}
+	}
+
+	s := newSubscriber(r, t.subscriberBuffer, replay)
+	t.subscribers[s] = struct{}{}
+	go s.run(ctx, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.subscribers, s)
+	})
+
+	return s, nil
+}
+
+// publish hands accepted writes to every subscriber, the caller must hold the lock
+func (t *temporalMap) publish(events ...Event) {
+	for s := range t.subscribers {
+		for _, e := range events {
+			s.push(e)
+		}
+	}
+}
@@ -26,6 +26,10 @@ type Map interface {
 	Update(timestamp time.Time, key string, value []byte)
 	Remove(timestamp time.Time, key string)
 	GetStateAtTime(timestamp time.Time) map[string][]byte
+	GetRangeHistory(from time.Time, to time.Time, r misc.KeyRange) map[string][]Entry
+	GetLatest(timestamp time.Time, key string) (Entry, bool)
+	GetRangeLatest(timestamp time.Time, r misc.KeyRange) map[string]Entry
+	Trim(timestamp time.Time)
 	// FindNextTimeKey(timestamp time.Time, dir int, key string) (time.Time, error)
 }
 
@@ -158,6 +162,87 @@ func (tm *mapImpl) GetStateAtTime(timestamp time.Time) map[string][]byte {
 	return state
 }
 
+// GetRangeHistory returns every value recorded for the keys in r between from and to
+// (inclusive) grouped by key.
+func (tm *mapImpl) GetRangeHistory(from time.Time, to time.Time, r misc.KeyRange) map[string][]Entry {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+
+	ret := map[string][]Entry{}
+	if key, ok := r.Key(); ok {
+		if item, ok := tm.Items[key]; ok {
+			if entries := item.Between(from, to); len(entries) > 0 {
+				ret[key] = entries
+			}
+		}
+		return ret
+	}
+
+	for key, item := range tm.Items {
+		if !r.Contains(key) {
+			continue
+		}
+		if entries := item.Between(from, to); len(entries) > 0 {
+			ret[key] = entries
+		}
+	}
+	return ret
+}
+
+// GetLatest returns the last value recorded for key on or before timestamp, including removals
+func (tm *mapImpl) GetLatest(timestamp time.Time, key string) (Entry, bool) {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+
+	if item, ok := tm.Items[key]; ok {
+		return item.Latest(timestamp)
+	}
+	return Entry{}, false
+}
+
+// GetRangeLatest returns the last value recorded on or before timestamp for every key in r
+// that has one, including removals.
+func (tm *mapImpl) GetRangeLatest(timestamp time.Time, r misc.KeyRange) map[string]Entry {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+
+	ret := map[string]Entry{}
+	for key, item := range tm.Items {
+		if !r.Contains(key) {
+			continue
+		}
+		if e, ok := item.Latest(timestamp); ok {
+			ret[key] = e
+		}
+	}
+	return ret
+}
+
+// Trim drops every value recorded before timestamp, keys left with no values are removed
+func (tm *mapImpl) Trim(timestamp time.Time) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	if !tm.MinTime.Before(timestamp) {
+		return
+	}
+	tm.MinTime, tm.MaxTime = time.Time{}, time.Time{}
+	for key, item := range tm.Items {
+		item.Trim(timestamp)
+		if len(item.Keyframes) == 0 {
+			delete(tm.Items, key)
+			continue
+		}
+		first, last := item.Keyframes[0].Timestamp, item.Keyframes[len(item.Keyframes)-1].Timestamp
+		if tm.MinTime.IsZero() || first.Before(tm.MinTime) {
+			tm.MinTime = first
+		}
+		if last.After(tm.MaxTime) {
+			tm.MaxTime = last
+		}
+	}
+}
+
 // func (tm *mapImpl) FindNextTimeKey(timestamp time.Time, dir int, key string) (time.Time, error) {
 // 	tm.lock.RLock()
 // 	defer tm.lock.RUnlock()
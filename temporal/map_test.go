@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"testing"
 	"time"
+
+	"github.com/hoyle1974/temporal/misc"
 )
 
 func createTestMap() (start, end, t1, t2, t3 time.Time, m Map) {
@@ -75,3 +77,26 @@ func TestBasicMap(t *testing.T) {
 	start, end, t1, t2, t3, m := createTestMap()
 	validateMap(t, start, end, t1, t2, t3, m)
 }
+
+func TestTrim(t *testing.T) {
+	start, end, t1, t2, t3, m := createTestMap()
+
+	m.Trim(t2)
+	if _, ok := m.GetLatest(t1, "key1"); ok {
+		t.Fatalf("Expected key1 at t1 to be trimmed")
+	}
+	if a := m.GetStateAtTime(t3); !bytes.Equal(a["key1"], []byte("key1value3")) || !bytes.Equal(a["key2"], []byte("key2value1")) {
+		t.Fatalf("Unexpected value for key1 or key2 at t3")
+	}
+	if min, max := m.GetTimeRange(); !min.Equal(t2) || !max.Equal(t3) {
+		t.Fatalf("Expected the time range to be %v to %v, not %v to %v", t2, t3, min, max)
+	}
+
+	m.Trim(end)
+	if a := m.GetStateAtTime(end); len(a) != 0 {
+		t.Fatalf("Expected empty map")
+	}
+	if a := m.GetRangeHistory(start, end, misc.KeyRange{}); len(a) != 0 {
+		t.Fatalf("Expected no history")
+	}
+}
@@ -256,6 +256,48 @@ func (store *TimeValueStore) queryValue(timestamp time.Time) []byte {
 	}
 }
 
+// Entry is a value recorded at a point in time, a nil Value marks a removal
+type Entry struct {
+	Timestamp time.Time
+	Value     []byte
+}
+
+// Latest returns the last value recorded on or before timestamp
+func (store *TimeValueStore) Latest(timestamp time.Time) (Entry, bool) {
+	index := sort.Search(len(store.Keyframes), func(j int) bool {
+		return store.Keyframes[j].Timestamp.After(timestamp)
+	})
+	if index == 0 {
+		return Entry{}, false
+	}
+	kf := store.Keyframes[index-1]
+	return Entry{Timestamp: kf.Timestamp, Value: kf.Value}, true
+}
+
+// Between returns every value recorded between from and to (inclusive) in timestamp order
+func (store *TimeValueStore) Between(from time.Time, to time.Time) []Entry {
+	start := sort.Search(len(store.Keyframes), func(j int) bool {
+		return !store.Keyframes[j].Timestamp.Before(from)
+	})
+
+	ret := []Entry{}
+	for _, kf := range store.Keyframes[start:] {
+		if kf.Timestamp.After(to) {
+			break
+		}
+		ret = append(ret, Entry{Timestamp: kf.Timestamp, Value: kf.Value})
+	}
+	return ret
+}
+
+// Trim drops every value recorded before timestamp
+func (store *TimeValueStore) Trim(timestamp time.Time) {
+	index := sort.Search(len(store.Keyframes), func(j int) bool {
+		return !store.Keyframes[j].Timestamp.Before(timestamp)
+	})
+	store.Keyframes = append([]keyFrame{}, store.Keyframes[index:]...)
+}
+
 /*
 func (store *TimeValueStore) FindNextTimeKey(timestamp time.Time, dir int) (time.Time, error) {
 	if dir == 0 {
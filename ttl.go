@@ -0,0 +1,120 @@
+package temporal
+
+import (
+	"container/heap"
+	"context"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// SetWithTTL implements ReadWriteMap.  The key is removed by a delete written at
+// timestamp+ttl unless it is written again first.  The delete is written once a later
+// write or the clock passes that time, or when the map is next opened.
+func (t *temporalMap) SetWithTTL(ctx context.Context, timestamp time.Time, key string, data []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("set with ttl: ttl must be positive")
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrMapClosed
+	}
+
+	return t.set(ctx, timestamp, key, data, timestamp.Add(ttl))
+}
+
+type expiry struct {
+	expires time.Time
+	key     string
+}
+
+// expiryQueue orders pending expiries by time.  Entries are not removed when a key is
+// written again, they are skipped if they no longer match expirations.
+type expiryQueue []expiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].expires.Before(q[j].expires) }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)        { *q = append(*q, x.(expiry)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// setExpiry records when key expires, a zero time means it doesn't
+func (t *temporalMap) setExpiry(key string, expires time.Time) {
+	if expires.IsZero() {
+		delete(t.expirations, key)
+		return
+	}
+	t.expirations[key] = expires
+	heap.Push(&t.expiryQueue, expiry{expires: expires, key: key})
+	t.scheduleExpiry()
+}
+
+// expired reports if key has expired by timestamp but the delete hasn't been written yet
+func (t *temporalMap) expired(key string, timestamp time.Time) bool {
+	expires, ok := t.expirations[key]
+	return ok && !expires.After(timestamp)
+}
+
+// expire writes a delete for every key that expires at or before timestamp, the caller
+// must hold the lock
+func (t *temporalMap) expire(ctx context.Context, timestamp time.Time) error {
+	for len(t.expiryQueue) > 0 && !t.expiryQueue[0].expires.After(timestamp) {
+		e := heap.Pop(&t.expiryQueue).(expiry)
+		if expires, ok := t.expirations[e.key]; !ok || !expires.Equal(e.expires) {
+			continue
+		}
+		if _, ok := t.data[e.key]; !ok {
+			delete(t.expirations, e.key)
+			continue
+		}
+
+		// Deletes can't go back in time, if we're already past the expiry it happens now
+		at := e.expires
+		if at.Before(t.current) {
+			at = t.current
+		}
+		if err := t.remove(ctx, at, e.key); err != nil {
+			heap.Push(&t.expiryQueue, e)
+			return errors.Wrapf(err, "can not expire %s", e.key)
+		}
+	}
+	return nil
+}
+
+// scheduleExpiry arms the timer for the next pending expiry, the caller must hold the lock
+func (t *temporalMap) scheduleExpiry() {
+	if t.closed || len(t.expiryQueue) == 0 {
+		return
+	}
+	next := t.expiryQueue[0].expires
+	if !t.nextExpiry.IsZero() && !next.Before(t.nextExpiry) {
+		return
+	}
+	t.nextExpiry = next
+
+	if t.expiryTimer != nil {
+		t.expiryTimer.Stop()
+	}
+	t.expiryTimer = time.AfterFunc(time.Until(next), t.onExpiryTimer)
+}
+
+func (t *temporalMap) onExpiryTimer() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+
+	t.nextExpiry = time.Time{}
+	if err := t.expire(context.Background(), time.Now()); err != nil {
+		t.logger.Error("can not expire keys", err)
+	}
+	t.scheduleExpiry()
+}